@@ -0,0 +1,95 @@
+package caddy_docker_upstreams
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+const (
+	addressModeContainerIP = "container_ip"
+	addressModePublished   = "published"
+	addressModeHost        = "host"
+)
+
+const defaultHostAddress = "127.0.0.1"
+
+// publishedPorts maps each published TCP port of a container to the host
+// address it is published on. Docker lists a port once per address family;
+// the IPv4 binding is preferred.
+func publishedPorts(ports []container.PortSummary) map[string]netip.AddrPort {
+	var published map[string]netip.AddrPort
+	for _, p := range ports {
+		if p.Type != "tcp" || p.PublicPort == 0 {
+			continue
+		}
+
+		private := strconv.Itoa(int(p.PrivatePort))
+		if prev, ok := published[private]; ok && !(prev.Addr().Is6() && p.IP.Is4()) {
+			continue
+		}
+
+		if published == nil {
+			published = make(map[string]netip.AddrPort)
+		}
+		published[private] = netip.AddrPortFrom(p.IP, p.PublicPort)
+	}
+	return published
+}
+
+// dial resolves the address this block dials the candidate at. It reports
+// false when the candidate cannot be reached under the block's configuration.
+func (u *Upstreams) dial(c candidate) (string, bool) {
+	// A socket is dialed as is; it has no port for this block to resolve.
+	if c.unix != "" {
+		return "unix/" + c.unix, true
+	}
+
+	// Resolve the port for this block: the port directive takes precedence
+	// over the per-container label. This is done here rather than at
+	// provision time because the blocks sharing a discovery key share their
+	// candidates, whatever their port directives.
+	port := u.Port
+	if port == "" {
+		port = c.port
+	}
+	if port == "" {
+		return "", false
+	}
+
+	switch u.AddressMode {
+	case addressModePublished:
+		// The port names the container port; dial the host port it is
+		// published on.
+		published, ok := c.published[port]
+		if !ok {
+			return "", false
+		}
+
+		host := u.Host
+		if host == "" {
+			host = defaultHostAddress
+			if addr := published.Addr(); addr.IsValid() && !addr.IsUnspecified() {
+				host = addr.String()
+			}
+		}
+		return net.JoinHostPort(host, strconv.Itoa(int(published.Port()))), true
+	case addressModeHost:
+		if c.hostNetwork {
+			host := u.Host
+			if host == "" {
+				host = defaultHostAddress
+			}
+			return net.JoinHostPort(host, port), true
+		}
+	}
+
+	// A container without an address of its own, e.g. in a Podman user
+	// mode network, is only reached through its published ports.
+	if c.address == "" {
+		return "", false
+	}
+	return net.JoinHostPort(c.address, port), true
+}
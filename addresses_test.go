@@ -0,0 +1,179 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishedPorts(t *testing.T) {
+	got := publishedPorts([]container.PortSummary{
+		{IP: netip.MustParseAddr("::"), PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+		{IP: netip.MustParseAddr("0.0.0.0"), PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+		{IP: netip.MustParseAddr("127.0.0.1"), PrivatePort: 8080, PublicPort: 18080, Type: "tcp"},
+		// Unpublished and non-TCP ports are ignored.
+		{PrivatePort: 9090, Type: "tcp"},
+		{IP: netip.MustParseAddr("0.0.0.0"), PrivatePort: 53, PublicPort: 53, Type: "udp"},
+	})
+
+	assert.Equal(t, map[string]netip.AddrPort{
+		"80":   netip.MustParseAddrPort("0.0.0.0:32768"),
+		"8080": netip.MustParseAddrPort("127.0.0.1:18080"),
+	}, got)
+}
+
+func TestProvisionCandidatesRecordsHostAddressing(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	published := summary("published",
+		map[string]string{LabelUpstreamPort: "80"},
+		map[string]string{"bridge": "10.0.0.1"},
+	)
+	published.Ports = []container.PortSummary{
+		{IP: netip.MustParseAddr("0.0.0.0"), PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+	}
+	host := summary("host",
+		map[string]string{LabelUpstreamPort: "8080"},
+		map[string]string{"host": "0.0.0.0"},
+	)
+	host.HostConfig.NetworkMode = "host"
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{published, host}}, nil)
+
+	var u Upstreams
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+	// Candidates are ordered by container ID.
+	require.Len(t, candidates, 2)
+	assert.True(t, candidates[0].hostNetwork)
+	assert.Equal(t, map[string]netip.AddrPort{"80": netip.MustParseAddrPort("0.0.0.0:32768")}, candidates[1].published)
+	assert.False(t, candidates[1].hostNetwork)
+}
+
+func TestGetUpstreamsAddressMode(t *testing.T) {
+	bridged := candidate{
+		address: "10.0.0.1",
+		port:    "80",
+		published: map[string]netip.AddrPort{
+			"80": netip.MustParseAddrPort("0.0.0.0:32768"),
+		},
+	}
+	loopback := candidate{
+		address: "10.0.0.2",
+		port:    "80",
+		published: map[string]netip.AddrPort{
+			"80": netip.MustParseAddrPort("127.0.0.1:32769"),
+		},
+	}
+	hostNetwork := candidate{address: "invalid IP", port: "80", hostNetwork: true}
+	socket := candidate{unix: "/run/app/app.sock"}
+
+	tests := []struct {
+		name      string
+		upstreams Upstreams
+		candidate candidate
+		wantDials []string
+	}{
+		{
+			name:      "container ip by default",
+			candidate: bridged,
+			wantDials: []string{"10.0.0.1:80"},
+		},
+		{
+			name:      "published on all addresses",
+			upstreams: Upstreams{AddressMode: addressModePublished},
+			candidate: bridged,
+			wantDials: []string{"127.0.0.1:32768"},
+		},
+		{
+			name:      "published on a specific address",
+			upstreams: Upstreams{AddressMode: addressModePublished},
+			candidate: loopback,
+			wantDials: []string{"127.0.0.1:32769"},
+		},
+		{
+			name:      "published with configured host",
+			upstreams: Upstreams{AddressMode: addressModePublished, Host: "192.168.1.10"},
+			candidate: bridged,
+			wantDials: []string{"192.168.1.10:32768"},
+		},
+		{
+			name:      "published port directive names the container port",
+			upstreams: Upstreams{AddressMode: addressModePublished, Port: "80"},
+			candidate: candidate{published: bridged.published},
+			wantDials: []string{"127.0.0.1:32768"},
+		},
+		{
+			name:      "unpublished port is dropped",
+			upstreams: Upstreams{AddressMode: addressModePublished, Port: "8080"},
+			candidate: bridged,
+			wantDials: []string{},
+		},
+		{
+			name:      "host network dials the host",
+			upstreams: Upstreams{AddressMode: addressModeHost},
+			candidate: hostNetwork,
+			wantDials: []string{"127.0.0.1:80"},
+		},
+		{
+			name:      "host network dials the configured host",
+			upstreams: Upstreams{AddressMode: addressModeHost, Host: "host.docker.internal"},
+			candidate: hostNetwork,
+			wantDials: []string{"host.docker.internal:80"},
+		},
+		{
+			name:      "host mode dials bridged containers by ip",
+			upstreams: Upstreams{AddressMode: addressModeHost},
+			candidate: bridged,
+			wantDials: []string{"10.0.0.1:80"},
+		},
+		{
+			name:      "unix socket needs no port",
+			candidate: socket,
+			wantDials: []string{"unix//run/app/app.sock"},
+		},
+		{
+			name:      "unix socket ignores the port directive",
+			upstreams: Upstreams{Port: "8080"},
+			candidate: socket,
+			wantDials: []string{"unix//run/app/app.sock"},
+		},
+		{
+			name:      "unix socket ignores the address mode",
+			upstreams: Upstreams{AddressMode: addressModePublished},
+			candidate: socket,
+			wantDials: []string{"unix//run/app/app.sock"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCandidates(t)
+			candidatesMu.Lock()
+			candidates = []candidate{tt.candidate}
+			candidatesMu.Unlock()
+
+			got, err := tt.upstreams.GetUpstreams(newRequest(t, http.MethodGet, "http://example.com/"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantDials, upstreamDials(got))
+		})
+	}
+}
+
+func TestValidateAddressMode(t *testing.T) {
+	assert.NoError(t, (&Upstreams{}).Validate())
+	assert.NoError(t, (&Upstreams{AddressMode: addressModePublished, Host: "10.0.0.1"}).Validate())
+	assert.Error(t, (&Upstreams{AddressMode: "bogus"}).Validate())
+	assert.Error(t, (&Upstreams{Host: "10.0.0.1"}).Validate())
+}
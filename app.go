@@ -0,0 +1,428 @@
+package caddy_docker_upstreams
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"go.uber.org/zap"
+)
+
+const LabelRouteLBPolicy = "com.caddyserver.http.route.lb_policy"
+
+const (
+	defaultRoutesServer = "srv0"
+	routeIDPrefix       = "docker_routes:"
+	adminRequestTimeout = 10 * time.Second
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+	httpcaddyfile.RegisterGlobalOption("docker_routes", parseAppOption)
+}
+
+// App generates the routes of an HTTP server from container labels, so a
+// container labeled with a host gets its own site, and certificate, without
+// editing the Caddyfile. It discovers containers like the upstream source
+// and, whenever their hosts and paths change, writes a route per host and
+// path to the server through Caddy's config API. Each route reverse proxies
+// to a docker upstream source selecting the containers by those labels, so
+// containers coming and going within a site do not change the config.
+//
+// Routes it generates carry an @id starting with docker_routes:; the
+// server's other routes are kept, after the generated ones.
+type App struct {
+	// Server names the server in the http app to add the routes to.
+	// Defaults to srv0, the first server of a Caddyfile.
+	Server string `json:"server,omitempty"`
+
+	// Admin is the address of Caddy's admin endpoint. Defaults to
+	// localhost:2019.
+	Admin string `json:"admin,omitempty"`
+
+	// LabelPrefix namespaces the labels the app reads, as the upstream
+	// source's label_prefix.
+	LabelPrefix string `json:"label_prefix,omitempty"`
+
+	upstreams *Upstreams
+	client    *http.Client
+	host      string // Host of the admin requests
+	ctx       caddy.Context
+	cancel    context.CancelFunc
+}
+
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "docker_routes",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+func (a *App) Provision(ctx caddy.Context) error {
+	a.Server = cmp.Or(a.Server, defaultRoutesServer)
+	a.Admin = cmp.Or(a.Admin, caddy.DefaultAdminListen)
+
+	addr, err := caddy.ParseNetworkAddress(a.Admin)
+	if err != nil {
+		return fmt.Errorf("parsing admin address: %w", err)
+	}
+	// The admin endpoint checks the Host of requests over TCP only.
+	a.host = "localhost"
+	if !addr.IsUnixNetwork() {
+		a.host = addr.JoinHostPort(0)
+	}
+	a.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, addr.Network, addr.JoinHostPort(0))
+		},
+	}}
+
+	a.ctx = ctx
+	// Stopped scale-to-zero containers keep their sites, so a request can
+	// start them.
+	a.upstreams = &Upstreams{
+		LabelPrefix:      a.LabelPrefix,
+		ScaleToZero:      true,
+		debounceInterval: defaultDebounceInterval,
+		reconnectDelay:   defaultReconnectDelay,
+	}
+	return a.upstreams.Provision(ctx)
+}
+
+func (a *App) Start() error {
+	ctx, cancel := caddy.NewContext(a.ctx)
+	a.cancel = cancel
+	go a.keepRoutes(ctx)
+	return nil
+}
+
+// Stop returns without waiting for keepRoutes, as the config change it may
+// be waiting on is what stops the app.
+func (a *App) Stop() error {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	return nil
+}
+
+func (a *App) Cleanup() error {
+	if a.upstreams == nil {
+		return nil
+	}
+	return a.upstreams.Cleanup()
+}
+
+// keepRoutes writes the routes once, then again on each candidate update that
+// changes them, until ctx is done. Writing the routes reloads the config,
+// which replaces this app with one that finds the routes up to date.
+func (a *App) keepRoutes(ctx caddy.Context) {
+	for {
+		changed := candidatesChanged()
+
+		err := a.syncRoutes(ctx)
+		if err != nil {
+			ctx.Logger().Error("unable to update routes", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// syncRoutes writes the generated routes to the server, unless it already
+// has them. The admin API appends to an existing array on POST, so the routes
+// are replaced with PATCH, or created with PUT when the server has none.
+func (a *App) syncRoutes(ctx caddy.Context) error {
+	path := "/config/apps/http/servers/" + a.Server + "/routes"
+
+	current, err := a.adminRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	updated, ok, err := mergeRoutes(current, a.routes())
+	if err != nil || !ok {
+		return err
+	}
+
+	method := http.MethodPatch
+	if isAbsent(current) {
+		method = http.MethodPut
+	}
+	_, err = a.adminRequest(method, path, updated)
+	if err != nil {
+		return err
+	}
+	ctx.Logger().Info("updated routes", zap.String("server", a.Server))
+	return nil
+}
+
+// adminRequest calls the admin endpoint. Its own timeout rather than the
+// app's context bounds it, as a config change stops the app mid-request.
+func (a *App) adminRequest(method, path string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+a.host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling admin endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading admin response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// routes generates a route per host and path label pair of the app's
+// candidates, reverse proxying to the containers that carry the pair.
+func (a *App) routes() []map[string]any {
+	type site struct{ host, path string }
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+
+	hostLabel, pathLabel := a.upstreams.label(LabelMatchHost), a.upstreams.label(LabelMatchPath)
+
+	var sites []site
+	hosts := make(map[site][]string) // host label values, before expansion
+	paths := make(map[site][]string) // path label values, before expansion
+	first := make(map[site]candidate)
+	idleStop := make(map[site]bool) // whether a container stops when idle
+	for _, c := range candidates {
+		if c.source != a.upstreams.source {
+			continue
+		}
+		s := site{
+			host: strings.Join(strings.Fields(c.host), " "),
+			path: strings.Join(strings.Fields(c.path), " "),
+		}
+		if s.host == "" {
+			continue
+		}
+		if _, ok := first[s]; !ok {
+			sites = append(sites, s)
+			first[s] = c
+		}
+		if host := c.labels[hostLabel]; !slices.Contains(hosts[s], host) {
+			hosts[s] = append(hosts[s], host)
+		}
+		if path, ok := c.labels[pathLabel]; ok && s.path != "" && !slices.Contains(paths[s], path) {
+			paths[s] = append(paths[s], path)
+		}
+		idleStop[s] = idleStop[s] || c.idleStop > 0
+	}
+
+	// Routes are tried in order: within a host, longer paths go first and
+	// the catch-all last.
+	slices.SortFunc(sites, func(a, b site) int {
+		return cmp.Or(
+			cmp.Compare(a.host, b.host),
+			cmp.Compare(len(b.path), len(a.path)),
+			cmp.Compare(a.path, b.path),
+		)
+	})
+
+	routes := make([]map[string]any, 0, len(sites))
+	for _, s := range sites {
+		match := map[string]any{"host": strings.Fields(s.host)}
+		if s.path != "" {
+			match["path"] = strings.Fields(s.path)
+		}
+
+		// The label values the site's containers carry select them, as
+		// written: the source expands templates per container.
+		labels := map[string][]string{hostLabel: slices.Sorted(slices.Values(hosts[s]))}
+		if len(paths[s]) > 0 {
+			labels[pathLabel] = slices.Sorted(slices.Values(paths[s]))
+		}
+
+		routes = append(routes, map[string]any{
+			"@id":      routeIDPrefix + strings.ReplaceAll(s.host+s.path, " ", ","),
+			"match":    []any{match},
+			"handle":   []any{a.handler(first[s], labels, idleStop[s])},
+			"terminal": true,
+		})
+	}
+	return routes
+}
+
+// handler configures the reverse proxy to the containers selected by labels,
+// with the options of the site's first container. The containers are found
+// by a docker upstream source at request time, so the route does not change
+// as they do. The source starts stopped containers when scaleToZero is set.
+func (a *App) handler(c candidate, labels map[string][]string, scaleToZero bool) map[string]any {
+	source := map[string]any{
+		"source": "docker",
+		"labels": labels,
+	}
+	if a.upstreams.LabelPrefix != "" {
+		source["label_prefix"] = a.upstreams.LabelPrefix
+	}
+	if scaleToZero {
+		source["scale_to_zero"] = true
+	}
+
+	handler := map[string]any{
+		"handler":           "reverse_proxy",
+		"dynamic_upstreams": source,
+	}
+	if policy := c.labels[a.upstreams.label(LabelRouteLBPolicy)]; policy != "" {
+		handler["load_balancing"] = map[string]any{
+			"selection_policy": map[string]any{"policy": policy},
+		}
+	}
+	// The source keeps to the containers the transport can speak to, and
+	// the TLS server name follows the container the proxy chose.
+	switch c.scheme {
+	case schemeH2C:
+		source["scheme"] = c.scheme
+		handler["transport"] = map[string]any{"protocol": "http", "versions": []any{"h2c", "2"}}
+	case schemeHTTPS:
+		source["scheme"] = c.scheme
+		handler["transport"] = map[string]any{"protocol": "http", "tls": map[string]any{"server_name": "{http.docker.tls_server_name}"}}
+	}
+	return handler
+}
+
+// mergeRoutes replaces the generated routes among the current routes of the
+// server with generated. It reports false when the routes are unchanged.
+func mergeRoutes(current []byte, generated []map[string]any) ([]byte, bool, error) {
+	var routes []any
+	if len(bytes.TrimSpace(current)) > 0 {
+		err := json.Unmarshal(current, &routes)
+		if err != nil {
+			return nil, false, fmt.Errorf("decoding routes: %w", err)
+		}
+	}
+
+	// Round-trip the generated routes so they compare with the decoded ones.
+	raw, err := json.Marshal(generated)
+	if err != nil {
+		return nil, false, err
+	}
+	var merged []any
+	err = json.Unmarshal(raw, &merged)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, route := range routes {
+		if !isGeneratedRoute(route) {
+			merged = append(merged, route)
+		}
+	}
+
+	if reflect.DeepEqual(routes, merged) || len(routes) == 0 && len(merged) == 0 {
+		return nil, false, nil
+	}
+
+	out, err := json.Marshal(merged)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// isAbsent reports whether a config value read from the admin API is
+// missing, which the API reads as null.
+func isAbsent(value []byte) bool {
+	value = bytes.TrimSpace(value)
+	return len(value) == 0 || bytes.Equal(value, []byte("null"))
+}
+
+func isGeneratedRoute(route any) bool {
+	m, ok := route.(map[string]any)
+	if !ok {
+		return false
+	}
+	id, _ := m["@id"].(string)
+	return strings.HasPrefix(id, routeIDPrefix)
+}
+
+// UnmarshalCaddyfile sets up the app from Caddyfile tokens.
+//
+//	docker_routes {
+//	    server <name>
+//	    admin <address>
+//	    label_prefix <prefix>
+//	}
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var field *string
+			switch d.Val() {
+			case "server":
+				field = &a.Server
+			case "admin":
+				field = &a.Admin
+			case "label_prefix":
+				field = &a.LabelPrefix
+			default:
+				return d.Errf("unrecognized docker_routes option '%s'", d.Val())
+			}
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			*field = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+// parseAppOption sets up the app from the docker_routes global option.
+func parseAppOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	var a App
+	err := a.UnmarshalCaddyfile(d)
+	if err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "docker_routes",
+		Value: caddyconfig.JSON(a, nil),
+	}, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App             = (*App)(nil)
+	_ caddy.Provisioner     = (*App)(nil)
+	_ caddy.CleanerUpper    = (*App)(nil)
+	_ caddyfile.Unmarshaler = (*App)(nil)
+)
@@ -0,0 +1,297 @@
+package caddy_docker_upstreams
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppRoutes(t *testing.T) {
+	withCandidates(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{source: "app", labels: map[string]string{LabelMatchHost: "example.com"}, host: "example.com", address: "10.0.0.1", port: "80"},
+		{source: "app", labels: map[string]string{LabelMatchHost: "example.com", LabelMatchPath: "/api/*", LabelRouteLBPolicy: "round_robin"}, host: "example.com", path: "/api/*", address: "10.0.0.2", port: "80"},
+		{source: "app", labels: map[string]string{LabelMatchHost: "example.com", LabelMatchPath: "/api/*"}, host: "example.com", path: "/api/*", address: "10.0.0.3", port: "80"},
+		// A template expanding to a host another container names outright
+		// shares its site.
+		{source: "app", labels: map[string]string{LabelMatchHost: "{container.name}.com"}, host: "example.com", address: "10.0.0.4", port: "80"},
+		{source: "app", labels: map[string]string{LabelMatchHost: "grpc.example.com"}, host: "grpc.example.com", address: "10.0.0.5", port: "80", scheme: schemeH2C, idleStop: time.Minute},
+		{source: "app", labels: map[string]string{}, address: "10.0.0.6", port: "80"},
+		{source: "other", labels: map[string]string{LabelMatchHost: "other.example.com"}, host: "other.example.com", address: "10.0.0.7", port: "80"},
+	}
+	candidatesMu.Unlock()
+
+	a := App{upstreams: &Upstreams{source: "app"}}
+	raw, err := json.Marshal(a.routes())
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `[
+		{
+			"@id": "docker_routes:example.com/api/*",
+			"match": [{"host": ["example.com"], "path": ["/api/*"]}],
+			"handle": [{
+				"handler": "reverse_proxy",
+				"dynamic_upstreams": {
+					"source": "docker",
+					"labels": {
+						"com.caddyserver.http.matchers.host": ["example.com"],
+						"com.caddyserver.http.matchers.path": ["/api/*"]
+					}
+				},
+				"load_balancing": {"selection_policy": {"policy": "round_robin"}}
+			}],
+			"terminal": true
+		},
+		{
+			"@id": "docker_routes:example.com",
+			"match": [{"host": ["example.com"]}],
+			"handle": [{
+				"handler": "reverse_proxy",
+				"dynamic_upstreams": {
+					"source": "docker",
+					"labels": {"com.caddyserver.http.matchers.host": ["example.com", "{container.name}.com"]}
+				}
+			}],
+			"terminal": true
+		},
+		{
+			"@id": "docker_routes:grpc.example.com",
+			"match": [{"host": ["grpc.example.com"]}],
+			"handle": [{
+				"handler": "reverse_proxy",
+				"dynamic_upstreams": {
+					"source": "docker",
+					"labels": {"com.caddyserver.http.matchers.host": ["grpc.example.com"]},
+					"scheme": "h2c",
+					"scale_to_zero": true
+				},
+				"transport": {"protocol": "http", "versions": ["h2c", "2"]}
+			}],
+			"terminal": true
+		}
+	]`, string(raw))
+
+	// Containers coming and going within the sites leave the routes as
+	// they are, so the config is not reloaded.
+	candidatesMu.Lock()
+	candidates = slices.Delete(candidates, 2, 3)
+	candidates = append(candidates, candidate{source: "app", labels: map[string]string{LabelMatchHost: "example.com"}, host: "example.com", address: "10.0.0.8", port: "80"})
+	candidatesMu.Unlock()
+
+	_, ok, err := mergeRoutes(raw, a.routes())
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestAppRoutesExpandTemplates(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	u := Upstreams{LabelPrefix: "com.example.internal"}
+	web := summary("web", map[string]string{
+		"com.example.internal.matchers.host": "{compose.service}-{compose.container_number}.example.com",
+		"com.example.internal.matchers.path": "/{label.tenant}/*",
+		"com.example.internal.upstream.port": "80",
+		composeServiceLabel:                  "web",
+		composeNumberLabel:                   "2",
+		"tenant":                             "acme",
+	}, map[string]string{"bridge": "10.0.0.1"})
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+		Return(client.ContainerListResult{Items: []container.Summary{web}}, nil)
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	a := App{upstreams: &u}
+	raw, err := json.Marshal(a.routes())
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `[
+		{
+			"@id": "docker_routes:web-2.example.com/acme/*",
+			"match": [{"host": ["web-2.example.com"], "path": ["/acme/*"]}],
+			"handle": [{
+				"handler": "reverse_proxy",
+				"dynamic_upstreams": {
+					"source": "docker",
+					"label_prefix": "com.example.internal",
+					"labels": {
+						"com.example.internal.matchers.host": ["{compose.service}-{compose.container_number}.example.com"],
+						"com.example.internal.matchers.path": ["/{label.tenant}/*"]
+					}
+				}
+			}],
+			"terminal": true
+		}
+	]`, string(raw))
+}
+
+func TestMergeRoutes(t *testing.T) {
+	generated := []map[string]any{
+		{"@id": "docker_routes:example.com", "terminal": true},
+	}
+
+	// Stale generated routes are replaced; the others are kept after them.
+	current := `[
+		{"@id": "docker_routes:gone.example.com", "terminal": true},
+		{"handle": [{"handler": "static_response"}]}
+	]`
+	merged, ok, err := mergeRoutes([]byte(current), generated)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.JSONEq(t, `[
+		{"@id": "docker_routes:example.com", "terminal": true},
+		{"handle": [{"handler": "static_response"}]}
+	]`, string(merged))
+
+	// Up to date.
+	_, ok, err = mergeRoutes(merged, generated)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// A server without routes and nothing to add.
+	_, ok, err = mergeRoutes([]byte("null\n"), nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = mergeRoutes([]byte("{"), generated)
+	assert.Error(t, err)
+}
+
+func TestAppSyncRoutes(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{source: "app", labels: map[string]string{LabelMatchHost: "example.com"}, host: "example.com", address: "10.0.0.1", port: "80"},
+	}
+	candidatesMu.Unlock()
+
+	// The fake admin endpoint follows Caddy's semantics for an array value:
+	// GET reads null while it is absent, PUT creates it, PATCH replaces it
+	// and POST appends to it.
+	var routes []any
+	var writes int
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config/apps/http/servers/srv0/routes" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			_ = json.NewEncoder(w).Encode(routes)
+			return
+		}
+
+		var value any
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writes++
+		switch r.Method {
+		case http.MethodPut:
+			if routes != nil {
+				http.Error(w, "key already exists", http.StatusConflict)
+				return
+			}
+			routes, _ = value.([]any)
+		case http.MethodPatch:
+			if routes == nil {
+				http.Error(w, "key does not exist", http.StatusNotFound)
+				return
+			}
+			routes, _ = value.([]any)
+		case http.MethodPost:
+			routes = append(routes, value)
+		}
+	}))
+	t.Cleanup(admin.Close)
+
+	a := App{
+		Server:    "srv0",
+		upstreams: &Upstreams{source: "app"},
+		client:    admin.Client(),
+		host:      strings.TrimPrefix(admin.URL, "http://"),
+	}
+
+	ids := func() []string {
+		var out []string
+		for _, route := range routes {
+			m, ok := route.(map[string]any)
+			require.True(t, ok, "route %v is not an object", route)
+			id, _ := m["@id"].(string)
+			out = append(out, id)
+		}
+		return out
+	}
+
+	require.NoError(t, a.syncRoutes(ctx))
+	assert.Equal(t, 1, writes)
+	assert.Equal(t, []string{"docker_routes:example.com"}, ids())
+
+	// The routes are up to date: nothing is written.
+	require.NoError(t, a.syncRoutes(ctx))
+	assert.Equal(t, 1, writes)
+
+	// A new container replaces the existing routes rather than nesting them.
+	candidatesMu.Lock()
+	candidates = append(candidates, candidate{source: "app", labels: map[string]string{LabelMatchHost: "other.example.com"}, host: "other.example.com", address: "10.0.0.2", port: "80"})
+	candidatesMu.Unlock()
+
+	require.NoError(t, a.syncRoutes(ctx))
+	assert.Equal(t, 2, writes)
+	assert.Equal(t, []string{"docker_routes:example.com", "docker_routes:other.example.com"}, ids())
+
+	a.Server = "missing"
+	assert.Error(t, a.syncRoutes(ctx))
+}
+
+func TestUnmarshalCaddyfileApp(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker_routes {
+		server srv1
+		admin unix//run/caddy/admin.sock
+		label_prefix com.example.internal
+	}`)
+	got, err := parseAppOption(d, nil)
+	require.NoError(t, err)
+
+	app, ok := got.(httpcaddyfile.App)
+	require.True(t, ok)
+	assert.Equal(t, "docker_routes", app.Name)
+	assert.JSONEq(t, `{
+		"server": "srv1",
+		"admin": "unix//run/caddy/admin.sock",
+		"label_prefix": "com.example.internal"
+	}`, string(app.Value))
+
+	for _, input := range []string{
+		`docker_routes foo`,
+		`docker_routes {
+			server
+		}`,
+		`docker_routes {
+			server srv0 srv1
+		}`,
+		`docker_routes {
+			listen :443
+		}`,
+	} {
+		var a App
+		assert.Error(t, a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
@@ -1,12 +1,45 @@
 package caddy_docker_upstreams
 
-import "github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
 
 // UnmarshalCaddyfile deserializes Caddyfile tokens into u.
 //
 //	dynamic docker {
 //	    label <key> <value...>
+//	    label_exists <key...>
+//	    label_not <key> [<value...>]
+//	    label_match <key> <regexp...>
+//	    label_selector <selector...>
+//	    container_name <glob...>
+//	    image <glob...>
+//	    compose_project <name>
+//	    compose_service <name...>
+//	    split [random|header <name>|cookie <name>] {
+//	        <weight>[%] <selector...>
+//	    }
+//	    route_by_label <label> header <name> [fallback <value>]
 //	    port <port>
+//	    auto_connect [<container>]
+//	    address_mode container_ip|published|host [<host>]
+//	    scheme http|h2c|https
+//	    enable_by label|default_on
+//	    health_policy healthy_only|healthy_or_none|include_starting|any
+//	    health_tls_trusted_ca_certs <pem_files...>
+//	    health_tls_insecure_skip_verify
+//	    status <status...>
+//	    filter <key> <value...>
+//	    drain_timeout <duration>
+//	    slow_start <duration>
+//	    label_prefix <prefix>
+//	    unavailable_error
+//	    wait_for_upstream <duration>
+//	    scale_to_zero
+//	    engine docker|podman
 //	}
 func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
@@ -25,6 +58,131 @@ func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				key, values := args[0], args[1:]
 				u.Labels[key] = append(u.Labels[key], values...)
+			case "label_exists":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.LabelExists = append(u.LabelExists, args...)
+			case "label_not":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				if u.LabelNot == nil {
+					u.LabelNot = make(map[string][]string)
+				}
+				key, values := args[0], args[1:]
+				u.LabelNot[key] = append(u.LabelNot[key], values...)
+			case "label_match":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				key, exprs := args[0], args[1:]
+				_, err := matchRequirement(key, exprs)
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				if u.LabelMatch == nil {
+					u.LabelMatch = make(map[string][]string)
+				}
+				u.LabelMatch[key] = append(u.LabelMatch[key], exprs...)
+			case "label_selector":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				selector := strings.Join(args, " ")
+				_, err := parseLabelSelector(selector)
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				if u.LabelSelector != "" {
+					selector = u.LabelSelector + ", " + selector
+				}
+				u.LabelSelector = selector
+			case "container_name", "image":
+				option := d.Val()
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, pattern := range args {
+					err := validGlob(pattern)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+				}
+				if option == "container_name" {
+					u.ContainerName = append(u.ContainerName, args...)
+				} else {
+					u.Image = append(u.Image, args...)
+				}
+			case "compose_project":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.ComposeProject = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "compose_service":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.ComposeService = append(u.ComposeService, args...)
+			case "split":
+				split := &Split{}
+				if d.NextArg() {
+					switch d.Val() {
+					case splitByRandom:
+					case splitByHeader, splitByCookie:
+						split.By = d.Val()
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						split.Name = d.Val()
+					default:
+						return d.Errf("unrecognized split by '%s'", d.Val())
+					}
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					args := append([]string{d.Val()}, d.RemainingArgs()...)
+					if len(args) < 2 {
+						return d.ArgErr()
+					}
+					group, err := parseSplitGroup(args)
+					if err != nil {
+						return d.WrapErr(err)
+					}
+					split.Groups = append(split.Groups, group)
+				}
+				err := split.validate()
+				if err != nil {
+					return d.WrapErr(err)
+				}
+				u.Split = split
+			case "route_by_label":
+				args := d.RemainingArgs()
+				if len(args) != 3 && len(args) != 5 {
+					return d.ArgErr()
+				}
+				if args[1] != "header" {
+					return d.Errf("unrecognized route_by_label source '%s'", args[1])
+				}
+				route := &RouteByLabel{Label: args[0], Header: args[2]}
+				if len(args) == 5 {
+					if args[3] != "fallback" {
+						return d.Errf("unrecognized route_by_label option '%s'", args[3])
+					}
+					route.Fallback = args[4]
+				}
+				u.RouteByLabel = route
 			case "port":
 				if !d.NextArg() {
 					return d.ArgErr()
@@ -33,11 +191,178 @@ func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if d.NextArg() {
 					return d.ArgErr()
 				}
+			case "auto_connect":
+				u.AutoConnect = true
+				if d.NextArg() {
+					u.Container = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "address_mode":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case addressModeContainerIP, addressModePublished, addressModeHost:
+					u.AddressMode = d.Val()
+				default:
+					return d.Errf("unrecognized address mode '%s'", d.Val())
+				}
+				if d.NextArg() {
+					if u.AddressMode == addressModeContainerIP {
+						return d.Errf("address mode '%s' does not take a host", u.AddressMode)
+					}
+					u.Host = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "scheme":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case schemeHTTP, schemeH2C, schemeHTTPS:
+					u.Scheme = d.Val()
+				default:
+					return d.Errf("unrecognized scheme '%s'", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "enable_by":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case enableByLabel, enableByDefaultOn:
+					u.EnableBy = d.Val()
+				default:
+					return d.Errf("unrecognized enable_by '%s'", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "health_policy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case healthPolicyHealthyOnly, healthPolicyHealthyOrNone, healthPolicyIncludeStarting, healthPolicyAny:
+					u.HealthPolicy = d.Val()
+				default:
+					return d.Errf("unrecognized health policy '%s'", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "health_tls_trusted_ca_certs":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.HealthTLSTrustedCACerts = append(u.HealthTLSTrustedCACerts, args...)
+			case "health_tls_insecure_skip_verify":
+				u.HealthTLSInsecureSkipVerify = true
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "status":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				u.Status = append(u.Status, args...)
+			case "filter":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				if u.Filters == nil {
+					u.Filters = make(map[string][]string)
+				}
+				key, values := args[0], args[1:]
+				u.Filters[key] = append(u.Filters[key], values...)
+			case "drain_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid drain timeout '%s': %v", d.Val(), err)
+				}
+				u.DrainTimeout = caddy.Duration(timeout)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "slow_start":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				window, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid slow start '%s': %v", d.Val(), err)
+				}
+				u.SlowStart = caddy.Duration(window)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "label_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				u.LabelPrefix = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "unavailable_error":
+				u.UnavailableError = true
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "wait_for_upstream":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				wait, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid wait for upstream '%s': %v", d.Val(), err)
+				}
+				u.WaitForUpstream = caddy.Duration(wait)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "scale_to_zero":
+				u.ScaleToZero = true
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "engine":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case engineDocker, enginePodman:
+					u.Engine = d.Val()
+				default:
+					return d.Errf("unrecognized engine '%s'", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 			default:
 				return d.Errf("unrecognized docker option '%s'", d.Val())
 			}
 		}
 	}
+
+	// The states a status may name depend on the engine, which may be set
+	// after it.
+	err := u.validateStatus()
+	if err != nil {
+		return d.WrapErr(err)
+	}
 	return nil
 }
 
@@ -2,7 +2,9 @@ package caddy_docker_upstreams
 
 import (
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/stretchr/testify/assert"
 )
@@ -140,3 +142,592 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 		})
 	}
 }
+
+func TestUnmarshalCaddyfileAutoConnect(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		wantErr       bool
+		wantContainer string
+	}{
+		{
+			name: "without container",
+			input: `docker {
+				auto_connect
+			}`,
+		},
+		{
+			name: "with container",
+			input: `docker {
+				auto_connect caddy
+			}`,
+			wantContainer: "caddy",
+		},
+		{
+			name: "too many arguments",
+			input: `docker {
+				auto_connect caddy other
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+
+			var u Upstreams
+			err := u.UnmarshalCaddyfile(d)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.True(t, u.AutoConnect)
+				assert.Equal(t, tt.wantContainer, u.Container)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileAddressMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantErr  bool
+		wantMode string
+		wantHost string
+	}{
+		{
+			name: "published",
+			input: `docker {
+				address_mode published
+			}`,
+			wantMode: addressModePublished,
+		},
+		{
+			name: "host with address",
+			input: `docker {
+				address_mode host host.docker.internal
+			}`,
+			wantMode: addressModeHost,
+			wantHost: "host.docker.internal",
+		},
+		{
+			name: "container ip with address",
+			input: `docker {
+				address_mode container_ip 10.0.0.1
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "unrecognized mode",
+			input: `docker {
+				address_mode bogus
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "without mode",
+			input: `docker {
+				address_mode
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+
+			var u Upstreams
+			err := u.UnmarshalCaddyfile(d)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantMode, u.AddressMode)
+				assert.Equal(t, tt.wantHost, u.Host)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileScheme(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantErr    bool
+		wantScheme string
+	}{
+		{
+			name: "h2c",
+			input: `docker {
+				scheme h2c
+			}`,
+			wantScheme: schemeH2C,
+		},
+		{
+			name: "https",
+			input: `docker {
+				scheme https
+			}`,
+			wantScheme: schemeHTTPS,
+		},
+		{
+			name: "unrecognized scheme",
+			input: `docker {
+				scheme ftp
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "without scheme",
+			input: `docker {
+				scheme
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "too many arguments",
+			input: `docker {
+				scheme http https
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+
+			var u Upstreams
+			err := u.UnmarshalCaddyfile(d)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantScheme, u.Scheme)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileDiscovery(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		wantErr          bool
+		wantHealthPolicy string
+		wantEnableBy     string
+		wantStatus       []string
+		wantFilters      map[string][]string
+	}{
+		{
+			name: "enable by",
+			input: `docker {
+				enable_by default_on
+			}`,
+			wantEnableBy: enableByDefaultOn,
+		},
+		{
+			name: "unrecognized enable by",
+			input: `docker {
+				enable_by always
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "enable by without value",
+			input: `docker {
+				enable_by
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "health policy",
+			input: `docker {
+				health_policy include_starting
+			}`,
+			wantHealthPolicy: healthPolicyIncludeStarting,
+		},
+		{
+			name: "unrecognized health policy",
+			input: `docker {
+				health_policy sometimes
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "health policy without value",
+			input: `docker {
+				health_policy
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "status",
+			input: `docker {
+				status running paused
+			}`,
+			wantStatus: []string{"running", "paused"},
+		},
+		{
+			name: "unrecognized status",
+			input: `docker {
+				status sleeping
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "status without value",
+			input: `docker {
+				status
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "filters",
+			input: `docker {
+				filter network backend
+				filter label com.docker.compose.project=demo
+				filter network frontend
+			}`,
+			wantFilters: map[string][]string{
+				"network": {"backend", "frontend"},
+				"label":   {"com.docker.compose.project=demo"},
+			},
+		},
+		{
+			name: "filter without value",
+			input: `docker {
+				filter network
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tt.input)
+
+			var u Upstreams
+			err := u.UnmarshalCaddyfile(d)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantHealthPolicy, u.HealthPolicy)
+				assert.Equal(t, tt.wantEnableBy, u.EnableBy)
+				assert.Equal(t, tt.wantStatus, u.Status)
+				assert.Equal(t, tt.wantFilters, u.Filters)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileDrainTimeout(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		drain_timeout 1m
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, caddy.Duration(time.Minute), u.DrainTimeout)
+
+	for _, input := range []string{
+		`docker {
+			drain_timeout
+		}`,
+		`docker {
+			drain_timeout soon
+		}`,
+		`docker {
+			drain_timeout 1m 2m
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileSlowStart(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		slow_start 2m
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, caddy.Duration(2*time.Minute), u.SlowStart)
+
+	for _, input := range []string{
+		`docker {
+			slow_start
+		}`,
+		`docker {
+			slow_start slowly
+		}`,
+		`docker {
+			slow_start 1m 2m
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileHealthTLS(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		health_tls_trusted_ca_certs /etc/caddy/internal-ca.pem
+		health_tls_trusted_ca_certs /etc/caddy/other-ca.pem
+		health_tls_insecure_skip_verify
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, []string{"/etc/caddy/internal-ca.pem", "/etc/caddy/other-ca.pem"}, u.HealthTLSTrustedCACerts)
+	assert.True(t, u.HealthTLSInsecureSkipVerify)
+
+	for _, input := range []string{
+		`docker {
+			health_tls_trusted_ca_certs
+		}`,
+		`docker {
+			health_tls_insecure_skip_verify true
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileLabelPrefix(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		label_prefix com.example.internal
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, "com.example.internal", u.LabelPrefix)
+
+	for _, input := range []string{
+		`docker {
+			label_prefix
+		}`,
+		`docker {
+			label_prefix com.example.internal com.example.external
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileLabelSelectors(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		label_exists com.docker.compose.service
+		label_not com.docker.compose.service canary
+		label_not legacy
+		label_match com.docker.compose.service ^api-v[0-9]+$
+		label_selector tier in (web, api)
+		label_selector !legacy
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, []string{"com.docker.compose.service"}, u.LabelExists)
+	assert.Equal(t, map[string][]string{
+		"com.docker.compose.service": {"canary"},
+		"legacy":                     nil,
+	}, u.LabelNot)
+	assert.Equal(t, map[string][]string{
+		"com.docker.compose.service": {`^api-v[0-9]+$`},
+	}, u.LabelMatch)
+	assert.Equal(t, "tier in (web, api), !legacy", u.LabelSelector)
+
+	for _, input := range []string{
+		`docker {
+			label_exists
+		}`,
+		`docker {
+			label_not
+		}`,
+		`docker {
+			label_match com.docker.compose.service
+		}`,
+		`docker {
+			label_match com.docker.compose.service (api
+		}`,
+		`docker {
+			label_selector
+		}`,
+		`docker {
+			label_selector tier in web
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileContainerSelectors(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		container_name shop-* blog-*
+		image nginx ghcr.io/example/*
+		compose_project shop
+		compose_service web
+		compose_service api
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, []string{"shop-*", "blog-*"}, u.ContainerName)
+	assert.Equal(t, []string{"nginx", "ghcr.io/example/*"}, u.Image)
+	assert.Equal(t, "shop", u.ComposeProject)
+	assert.Equal(t, []string{"web", "api"}, u.ComposeService)
+
+	for _, input := range []string{
+		`docker {
+			container_name
+		}`,
+		`docker {
+			container_name web-[
+		}`,
+		`docker {
+			image
+		}`,
+		`docker {
+			image nginx:[
+		}`,
+		`docker {
+			compose_project
+		}`,
+		`docker {
+			compose_project shop blog
+		}`,
+		`docker {
+			compose_service
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileUnavailableError(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		unavailable_error
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.True(t, u.UnavailableError)
+
+	d = caddyfile.NewTestDispenser(`docker {
+		unavailable_error yes
+	}`)
+	assert.Error(t, u.UnmarshalCaddyfile(d))
+}
+
+func TestUnmarshalCaddyfileWaitForUpstream(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		wait_for_upstream 5s
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, caddy.Duration(5*time.Second), u.WaitForUpstream)
+
+	for _, input := range []string{
+		`docker {
+			wait_for_upstream
+		}`,
+		`docker {
+			wait_for_upstream soon
+		}`,
+		`docker {
+			wait_for_upstream 1s 2s
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileScaleToZero(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		scale_to_zero
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.True(t, u.ScaleToZero)
+
+	d = caddyfile.NewTestDispenser(`docker {
+		scale_to_zero 5m
+	}`)
+	assert.Error(t, u.UnmarshalCaddyfile(d))
+}
+
+func TestUnmarshalCaddyfileEngine(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		engine podman
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, enginePodman, u.Engine)
+
+	for _, input := range []string{
+		`docker {
+			engine
+		}`,
+		`docker {
+			engine podman docker
+		}`,
+		`docker {
+			engine dokcer
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
+
+func TestUnmarshalCaddyfileEngineStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{
+			name: "podman stopped",
+			input: `docker {
+				engine podman
+				status running stopped
+			}`,
+		},
+		{
+			name: "podman stopped before engine",
+			input: `docker {
+				status running stopped
+				engine podman
+			}`,
+		},
+		{
+			name: "docker stopped",
+			input: `docker {
+				status running stopped
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var u Upstreams
+			err := u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, []string{"running", "stopped"}, u.Status)
+				assert.NoError(t, u.Validate())
+			}
+		})
+	}
+}
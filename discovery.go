@@ -0,0 +1,198 @@
+package caddy_docker_upstreams
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/client"
+)
+
+const (
+	healthPolicyHealthyOnly     = "healthy_only"
+	healthPolicyHealthyOrNone   = "healthy_or_none"
+	healthPolicyIncludeStarting = "include_starting"
+	healthPolicyAny             = "any"
+)
+
+const (
+	enableByLabel     = "label"
+	enableByDefaultOn = "default_on"
+)
+
+var defaultStatus = []string{string(container.StateRunning)}
+
+// filters returns the Docker API filters this block lists containers with.
+func (u *Upstreams) filters() client.Filters {
+	filters := client.Filters{}
+	if u.EnableBy != enableByDefaultOn {
+		filters.Add("label", fmt.Sprintf("%s=true", u.label(LabelEnable)))
+	}
+
+	status := u.Status
+	if len(status) == 0 {
+		status = defaultStatus
+	}
+	filters.Add("status", status...) // container.State.Status
+
+	if !u.healthInCode() {
+		switch u.HealthPolicy {
+		case healthPolicyHealthyOnly:
+			filters.Add("health", string(container.Healthy))
+		case "", healthPolicyHealthyOrNone:
+			filters.Add("health", string(container.Healthy), string(container.NoHealthcheck))
+		case healthPolicyIncludeStarting:
+			filters.Add("health", string(container.Healthy), string(container.NoHealthcheck), string(container.Starting))
+		case healthPolicyAny:
+		}
+	}
+
+	// Push the label selectors the daemon can evaluate down to it, so it
+	// lists only the containers this block may select. Docker ANDs label
+	// filters, so a key listing several values is left to selects.
+	for key, values := range u.Labels {
+		if len(values) == 1 {
+			filters.Add("label", key+"="+values[0])
+		}
+	}
+	for _, req := range u.requirements {
+		switch {
+		case req.op == selectorExists:
+			filters.Add("label", req.key)
+		case req.op == selectorIn && len(req.values) == 1:
+			filters.Add("label", req.key+"="+req.values[0])
+		}
+	}
+
+	for key, values := range u.Filters {
+		filters.Add(key, values...)
+	}
+
+	return filters
+}
+
+// healthInCode reports whether the health policy is applied to the listed
+// containers by admitsHealth rather than by the list filters: Podman's list
+// cannot be filtered on health, and with UnavailableError the containers the
+// policy leaves out are kept to tell why no upstream is available.
+func (u *Upstreams) healthInCode() bool {
+	return u.Engine == enginePodman || u.UnavailableError
+}
+
+// eventFilters returns the Docker API filters this block watches container
+// events with: the label filters of its container list, which Docker applies
+// to the container an event is about.
+func (u *Upstreams) eventFilters() client.Filters {
+	filters := client.Filters{}.Add("type", string(events.ContainerEventType))
+	for label := range u.filters()["label"] {
+		filters.Add("label", label)
+	}
+	return filters
+}
+
+// discoveryKey identifies the containers this block discovers, and how it
+// reads them. Blocks that list containers the same way, and build candidates
+// from the same labels, share one partition of the candidates, so they agree
+// on the candidates whichever of them provisioned last, while other blocks
+// keep out of each other's way.
+func (u *Upstreams) discoveryKey() string {
+	var stopped client.Filters
+	if u.ScaleToZero {
+		stopped = u.stoppedFilters()
+	}
+
+	// A health policy applied in code decides which containers provisioning
+	// keeps, and how it holds them back, where the filters do not show it.
+	var healthPolicy string
+	var unavailableError bool
+	if u.healthInCode() {
+		healthPolicy = cmp.Or(u.HealthPolicy, healthPolicyHealthyOrNone)
+		unavailableError = u.UnavailableError
+	}
+
+	// Marshaling builtin types should never fail; JSON sorts the map keys,
+	// so equal filters always produce the same key. The label prefix is
+	// part of the key as provisioning renames the labels under it, which
+	// the filters do not always show, e.g. with enable_by default_on.
+	key, _ := json.Marshal(struct {
+		Filters          client.Filters
+		Stopped          client.Filters `json:",omitempty"`
+		LabelPrefix      string
+		Engine           string
+		HealthPolicy     string `json:",omitempty"`
+		UnavailableError bool   `json:",omitempty"`
+	}{
+		Filters:          u.filters(),
+		Stopped:          stopped,
+		LabelPrefix:      u.labelPrefix(),
+		Engine:           cmp.Or(u.Engine, engineDocker),
+		HealthPolicy:     healthPolicy,
+		UnavailableError: unavailableError,
+	})
+	return string(key)
+}
+
+// replaceSource returns cs with the candidates from source replaced by
+// updated. It builds a new slice so earlier snapshots stay intact.
+func replaceSource(cs []candidate, source string, updated []candidate) []candidate {
+	out := make([]candidate, 0, len(cs)+len(updated))
+	for _, c := range cs {
+		if c.source != source {
+			out = append(out, c)
+		}
+	}
+	return append(out, updated...)
+}
+
+// sources counts the provisioned blocks per discovery key, so a partition is
+// dropped only when the last block using it is cleaned up. Across a config
+// reload the new blocks are provisioned before the old ones are cleaned up,
+// which keeps a shared partition alive.
+var (
+	sources   = make(map[string]int)
+	sourcesMu sync.Mutex
+)
+
+func retainSource(source string) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[source]++
+}
+
+func releaseSource(source string) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	sources[source]--
+	if sources[source] > 0 {
+		return
+	}
+	delete(sources, source)
+
+	candidatesMu.Lock()
+	candidates = replaceSource(candidates, source, nil)
+	notifyChanged()
+	candidatesMu.Unlock()
+}
+
+// changed is closed, and replaced, whenever the candidates are updated, so
+// others can wait for the next update. It is guarded by candidatesMu.
+var changed = make(chan struct{})
+
+// notifyChanged wakes those waiting for an update. It must be called with
+// candidatesMu held for writing.
+func notifyChanged() {
+	close(changed)
+	changed = make(chan struct{})
+}
+
+// candidatesChanged returns a channel closed on the next update of the
+// candidates.
+func candidatesChanged() <-chan struct{} {
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+	return changed
+}
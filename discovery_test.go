@@ -0,0 +1,283 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// withSources saves and restores the package-level discovery key counts.
+func withSources(t *testing.T) {
+	t.Helper()
+	sourcesMu.Lock()
+	prev := sources
+	sources = make(map[string]int)
+	sourcesMu.Unlock()
+	t.Cleanup(func() {
+		sourcesMu.Lock()
+		sources = prev
+		sourcesMu.Unlock()
+	})
+}
+
+func TestFilters(t *testing.T) {
+	enable := map[string]bool{LabelEnable + "=true": true}
+	running := map[string]bool{"running": true}
+
+	tests := []struct {
+		name      string
+		upstreams Upstreams
+		want      client.Filters
+	}{
+		{
+			name: "defaults",
+			want: client.Filters{
+				"label":  enable,
+				"status": running,
+				"health": {"healthy": true, "none": true},
+			},
+		},
+		{
+			name:      "healthy only",
+			upstreams: Upstreams{HealthPolicy: healthPolicyHealthyOnly},
+			want: client.Filters{
+				"label":  enable,
+				"status": running,
+				"health": {"healthy": true},
+			},
+		},
+		{
+			name:      "include starting",
+			upstreams: Upstreams{HealthPolicy: healthPolicyIncludeStarting},
+			want: client.Filters{
+				"label":  enable,
+				"status": running,
+				"health": {"healthy": true, "none": true, "starting": true},
+			},
+		},
+		{
+			name:      "any health",
+			upstreams: Upstreams{HealthPolicy: healthPolicyAny},
+			want: client.Filters{
+				"label":  enable,
+				"status": running,
+			},
+		},
+		{
+			name:      "default on",
+			upstreams: Upstreams{EnableBy: enableByDefaultOn, ComposeProject: "shop"},
+			want: client.Filters{
+				"status": running,
+				"health": {"healthy": true, "none": true},
+			},
+		},
+		{
+			name:      "status",
+			upstreams: Upstreams{Status: []string{"running", "paused"}},
+			want: client.Filters{
+				"label":  enable,
+				"status": {"running": true, "paused": true},
+				"health": {"healthy": true, "none": true},
+			},
+		},
+		{
+			name: "extra filters are merged",
+			upstreams: Upstreams{Filters: map[string][]string{
+				"label":   {"com.docker.compose.project=demo"},
+				"network": {"backend"},
+			}},
+			want: client.Filters{
+				"label":   {LabelEnable + "=true": true, "com.docker.compose.project=demo": true},
+				"status":  running,
+				"health":  {"healthy": true, "none": true},
+				"network": {"backend": true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.upstreams.filters())
+		})
+	}
+}
+
+func TestFiltersPushesDownLabelSelectors(t *testing.T) {
+	u := Upstreams{
+		Labels: map[string][]string{
+			"com.docker.compose.project": {"demo"},
+			"com.docker.compose.service": {"web", "api"},
+		},
+		LabelExists:   []string{"tier"},
+		LabelNot:      map[string][]string{"track": {"canary"}},
+		LabelMatch:    map[string][]string{"version": {"^v2"}},
+		LabelSelector: "env=prod, region in (eu,us)",
+	}
+	require.NoError(t, u.compileSelectors())
+
+	// Only the selectors Docker can evaluate with ANDed label filters are
+	// pushed down; the others are left to selects.
+	assert.Equal(t, map[string]bool{
+		LabelEnable + "=true":             true,
+		"com.docker.compose.project=demo": true,
+		"tier":                            true,
+		"env=prod":                        true,
+	}, u.filters()["label"])
+
+	assert.Equal(t, client.Filters{
+		"type": {"container": true},
+		"label": {
+			LabelEnable + "=true":             true,
+			"com.docker.compose.project=demo": true,
+			"tier":                            true,
+			"env=prod":                        true,
+		},
+	}, u.eventFilters())
+}
+
+func TestDiscoveryKey(t *testing.T) {
+	a := Upstreams{Port: "8080", Labels: map[string][]string{"service": {"a", "b"}}}
+	b := Upstreams{Port: "9090"}
+	assert.Equal(t, a.discoveryKey(), b.discoveryKey(),
+		"blocks that list containers the same way must share candidates")
+
+	e := Upstreams{Labels: map[string][]string{"service": {"a"}}}
+	assert.NotEqual(t, a.discoveryKey(), e.discoveryKey(),
+		"a pushed-down selector lists containers differently")
+
+	c := Upstreams{HealthPolicy: healthPolicyAny}
+	assert.NotEqual(t, a.discoveryKey(), c.discoveryKey())
+
+	d := Upstreams{Filters: map[string][]string{"network": {"backend"}}}
+	assert.NotEqual(t, a.discoveryKey(), d.discoveryKey())
+
+	// Without the enable label filter, only the label prefix tells blocks
+	// reading different labels apart.
+	internal := Upstreams{EnableBy: enableByDefaultOn, LabelPrefix: "com.example.internal"}
+	external := Upstreams{EnableBy: enableByDefaultOn, LabelPrefix: "com.example.external"}
+	assert.NotEqual(t, internal.discoveryKey(), external.discoveryKey())
+
+	prefixed := Upstreams{LabelPrefix: DefaultLabelPrefix + "."}
+	assert.Equal(t, b.discoveryKey(), prefixed.discoveryKey(),
+		"an explicit default prefix reads the same labels")
+
+	// Podman's list is not filtered on health, so only the key tells
+	// blocks with different health policies apart.
+	healthyOnly := Upstreams{Engine: enginePodman, HealthPolicy: healthPolicyHealthyOnly}
+	anyHealth := Upstreams{Engine: enginePodman, HealthPolicy: healthPolicyAny}
+	assert.NotEqual(t, healthyOnly.discoveryKey(), anyHealth.discoveryKey())
+
+	podman := Upstreams{Engine: enginePodman}
+	defaulted := Upstreams{Engine: enginePodman, HealthPolicy: healthPolicyHealthyOrNone}
+	assert.Equal(t, podman.discoveryKey(), defaulted.discoveryKey(),
+		"the default health policy keeps the same candidates")
+}
+
+func TestProvisionCandidatesListsWithBlockFilters(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	u := Upstreams{HealthPolicy: healthPolicyIncludeStarting, Filters: map[string][]string{"network": {"backend"}}}
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+		Return(client.ContainerListResult{}, nil)
+
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+	cli.AssertExpectations(t)
+}
+
+func TestProvisionCandidatesKeepsOtherSources(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	running := &Upstreams{source: "running"}
+	starting := &Upstreams{source: "starting"}
+
+	list := func(ip string) *mockDockerClient {
+		cli := &mockDockerClient{}
+		cli.On("ContainerList", mock.Anything, mock.Anything).
+			Return(client.ContainerListResult{Items: []container.Summary{
+				summary(ip,
+					map[string]string{LabelUpstreamPort: "8080"},
+					map[string]string{"bridge": ip},
+				),
+			}}, nil)
+		return cli
+	}
+
+	require.NoError(t, running.provisionCandidates(ctx, list("10.0.0.1")))
+	require.NoError(t, starting.provisionCandidates(ctx, list("10.0.0.2")))
+	// A refresh replaces only the block's own partition.
+	require.NoError(t, running.provisionCandidates(ctx, list("10.0.0.3")))
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+
+	got, err := running.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.3:8080"}, upstreamDials(got))
+
+	got, err = starting.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2:8080"}, upstreamDials(got))
+}
+
+func TestReleaseSource(t *testing.T) {
+	withCandidates(t)
+	withSources(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{source: "shared", address: "10.0.0.1", port: "8080"},
+		{source: "other", address: "10.0.0.2", port: "8080"},
+	}
+	candidatesMu.Unlock()
+
+	// Two blocks share a partition, as across a config reload.
+	retainSource("shared")
+	retainSource("shared")
+	retainSource("other")
+
+	releaseSource("shared")
+	assert.Equal(t, 2, candidateCount(), "the partition is still in use")
+
+	releaseSource("shared")
+	candidatesMu.RLock()
+	assert.Equal(t, []string{"10.0.0.2:8080"}, dials(candidates))
+	candidatesMu.RUnlock()
+}
+
+func TestValidateDiscovery(t *testing.T) {
+	assert.NoError(t, (&Upstreams{HealthPolicy: healthPolicyAny, Status: []string{"running", "paused"}}).Validate())
+	assert.NoError(t, (&Upstreams{EnableBy: enableByDefaultOn}).Validate())
+	assert.Error(t, (&Upstreams{EnableBy: "always"}).Validate())
+	assert.Error(t, (&Upstreams{HealthPolicy: "sometimes"}).Validate())
+	assert.Error(t, (&Upstreams{Status: []string{"sleeping"}}).Validate())
+}
+
+func TestProvisionCandidatesEnabledByDefault(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	u := Upstreams{EnableBy: enableByDefaultOn, Port: "80"}
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+		Return(client.ContainerListResult{Items: []container.Summary{
+			summary("a", nil, map[string]string{"bridge": "10.0.0.1"}),
+			summary("b", map[string]string{LabelEnable: "false"}, map[string]string{"bridge": "10.0.0.2"}),
+			summary("c", map[string]string{LabelEnable: "true"}, map[string]string{"bridge": "10.0.0.3"}),
+		}}, nil)
+
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+	cli.AssertExpectations(t)
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, dials(candidates), "containers opt out with enable=false")
+}
@@ -0,0 +1,91 @@
+package caddy_docker_upstreams
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/events"
+)
+
+const LabelDrain = "com.caddyserver.http.drain"
+
+const defaultDrainTimeout = 30 * time.Second
+
+// draining records when each container was seen stopping, by container ID.
+// A stopping container stays listed until its die event is debounced into a
+// refresh, so it is kept out of GetUpstreams from the first kill or stop
+// event instead; requests already proxied to it are left to finish.
+var (
+	draining   = make(map[string]time.Time)
+	drainingMu sync.RWMutex
+)
+
+// observeDrain updates the draining record from a container event.
+func observeDrain(msg events.Message) {
+	switch msg.Action {
+	case events.ActionKill, events.ActionStop:
+		if msg.Action == events.ActionKill && !terminates(msg.Actor.Attributes["signal"]) {
+			return
+		}
+		drainingMu.Lock()
+		if _, ok := draining[msg.Actor.ID]; !ok {
+			draining[msg.Actor.ID] = time.Now()
+		}
+		drainingMu.Unlock()
+	case events.ActionStart:
+		drainingMu.Lock()
+		delete(draining, msg.Actor.ID)
+		drainingMu.Unlock()
+	}
+}
+
+// pruneDraining forgets the containers that are no longer candidates.
+func pruneDraining(cs []candidate) {
+	present := make(map[string]bool, len(cs))
+	for _, c := range cs {
+		present[c.id] = true
+	}
+
+	drainingMu.Lock()
+	defer drainingMu.Unlock()
+	for id := range draining {
+		if !present[id] {
+			delete(draining, id)
+		}
+	}
+}
+
+// drains reports whether the candidate is draining for this block: it carries
+// the drain label, or it was seen stopping within the drain timeout. A
+// container that outlives the timeout, e.g. after a signal it handles without
+// exiting, is considered again.
+func (u *Upstreams) drains(c candidate) bool {
+	if c.drain {
+		return true
+	}
+
+	drainingMu.RLock()
+	since, ok := draining[c.id]
+	drainingMu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	timeout := time.Duration(u.DrainTimeout)
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+	return time.Since(since) < timeout
+}
+
+// terminates reports whether the signal of a kill event stops the container.
+// Other signals, such as HUP or USR1 for a config reload, leave it serving.
+// Docker reports the signal number; a kill without one is taken to stop it.
+func terminates(signal string) bool {
+	switch strings.TrimPrefix(strings.ToUpper(signal), "SIG") {
+	case "", "15", "TERM", "2", "INT", "9", "KILL", "3", "QUIT":
+		return true
+	}
+	return false
+}
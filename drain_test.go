@@ -0,0 +1,167 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/moby/moby/api/types/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// withDraining saves and restores the package-level draining record.
+func withDraining(t *testing.T) {
+	t.Helper()
+	drainingMu.Lock()
+	prev := draining
+	draining = make(map[string]time.Time)
+	drainingMu.Unlock()
+	t.Cleanup(func() {
+		drainingMu.Lock()
+		draining = prev
+		drainingMu.Unlock()
+	})
+}
+
+func containerEvent(action events.Action, id string) events.Message {
+	return events.Message{Type: events.ContainerEventType, Action: action, Actor: events.Actor{ID: id}}
+}
+
+func isDraining(id string) bool {
+	drainingMu.RLock()
+	defer drainingMu.RUnlock()
+	_, ok := draining[id]
+	return ok
+}
+
+func TestObserveDrain(t *testing.T) {
+	withDraining(t)
+
+	observeDrain(containerEvent(events.ActionKill, "a"))
+	observeDrain(containerEvent(events.ActionStop, "b"))
+	observeDrain(containerEvent(events.ActionDie, "c"))
+	assert.True(t, isDraining("a"))
+	assert.True(t, isDraining("b"))
+	assert.False(t, isDraining("c"), "only kill and stop start draining")
+
+	// The first event is kept, so a stop after a kill does not extend it.
+	drainingMu.RLock()
+	first := draining["a"]
+	drainingMu.RUnlock()
+	observeDrain(containerEvent(events.ActionStop, "a"))
+	drainingMu.RLock()
+	assert.Equal(t, first, draining["a"])
+	drainingMu.RUnlock()
+
+	// A restarted container is back in service.
+	observeDrain(containerEvent(events.ActionStart, "a"))
+	assert.False(t, isDraining("a"))
+}
+
+func TestObserveDrainIgnoresReloadSignals(t *testing.T) {
+	withDraining(t)
+
+	kill := func(id, signal string) events.Message {
+		msg := containerEvent(events.ActionKill, id)
+		msg.Actor.Attributes = map[string]string{"signal": signal}
+		return msg
+	}
+
+	observeDrain(kill("hup", "1"))
+	observeDrain(kill("usr1", "SIGUSR1"))
+	observeDrain(kill("term", "15"))
+	observeDrain(kill("int", "SIGINT"))
+	observeDrain(kill("kill", "9"))
+	observeDrain(kill("quit", "QUIT"))
+
+	assert.False(t, isDraining("hup"), "a HUP reloads the container")
+	assert.False(t, isDraining("usr1"))
+	for _, id := range []string{"term", "int", "kill", "quit"} {
+		assert.True(t, isDraining(id), id)
+	}
+}
+
+func TestPruneDraining(t *testing.T) {
+	withDraining(t)
+
+	observeDrain(containerEvent(events.ActionKill, "kept"))
+	observeDrain(containerEvent(events.ActionKill, "gone"))
+
+	pruneDraining([]candidate{{id: "kept"}})
+	assert.True(t, isDraining("kept"))
+	assert.False(t, isDraining("gone"))
+}
+
+func TestGetUpstreamsSkipsDraining(t *testing.T) {
+	withCandidates(t)
+	withDraining(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{id: "serving", address: "10.0.0.1", port: "8080"},
+		{id: "labelled", address: "10.0.0.2", port: "8080", drain: true},
+		{id: "stopping", address: "10.0.0.3", port: "8080"},
+		{id: "survived", address: "10.0.0.4", port: "8080"},
+	}
+	candidatesMu.Unlock()
+
+	drainingMu.Lock()
+	draining["stopping"] = time.Now()
+	draining["survived"] = time.Now().Add(-time.Minute)
+	drainingMu.Unlock()
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+
+	t.Run("default timeout", func(t *testing.T) {
+		var u Upstreams
+		got, err := u.GetUpstreams(req)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"10.0.0.1:8080", "10.0.0.4:8080"}, upstreamDials(got))
+	})
+
+	t.Run("longer timeout", func(t *testing.T) {
+		u := Upstreams{DrainTimeout: caddy.Duration(2 * time.Minute)}
+		got, err := u.GetUpstreams(req)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"10.0.0.1:8080"}, upstreamDials(got))
+	})
+}
+
+func TestKeepUpdatedDrainsOnKill(t *testing.T) {
+	withCandidates(t)
+	withDraining(t)
+	ctx, _ := newCancelableContext(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "a", address: "10.0.0.1", port: "8080"}}
+	candidatesMu.Unlock()
+
+	stream := newEventStream()
+	cli := &mockDockerClient{}
+	cli.On("Events", mock.Anything, mock.Anything).Return(stream.result())
+	cli.On("ContainerList", mock.Anything, mock.Anything).Return(oneContainerResult(), nil)
+	cli.On("Close").Return(nil)
+
+	// A long debounce keeps the refresh out of the way: the kill alone must
+	// take the container out of service.
+	u := &Upstreams{debounceInterval: time.Hour, reconnectDelay: time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		u.keepUpdated(ctx, cli)
+		close(done)
+	}()
+
+	stream.messages <- containerEvent(events.ActionKill, "a")
+	require.Eventually(t, func() bool { return isDraining("a") }, 2*time.Second, time.Millisecond)
+
+	got, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://example.com/"))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	stream.errs <- context.Canceled
+	awaitReturn(t, done)
+}
@@ -0,0 +1,337 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/moby/moby/api/types/container"
+	"go.uber.org/zap"
+)
+
+const (
+	LabelHealthPath     = "com.caddyserver.http.health.path"
+	LabelHealthInterval = "com.caddyserver.http.health.interval"
+	LabelHealthStatus   = "com.caddyserver.http.health.status"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthStatus   = "2xx"
+	defaultHealthTimeout  = 5 * time.Second
+	healthCheckTick       = time.Second
+	healthCheckWorkers    = 4
+)
+
+// healthCheck is a container's active health check, from its health labels.
+type healthCheck struct {
+	path     string // request path; no check when empty
+	interval time.Duration
+	status   string // expected status code, e.g. 200, or class, e.g. 2xx
+}
+
+// parseHealthCheck reads the container's health labels. An invalid label is
+// logged and leaves the container unchecked, as Docker's own health filter
+// still applies to it.
+func parseHealthCheck(ctx caddy.Context, c container.Summary) healthCheck {
+	path, ok := c.Labels[LabelHealthPath]
+	if !ok {
+		return healthCheck{}
+	}
+
+	check := healthCheck{
+		path:     path,
+		interval: defaultHealthInterval,
+		status:   defaultHealthStatus,
+	}
+
+	if value, ok := c.Labels[LabelHealthInterval]; ok {
+		interval, err := caddy.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			ctx.Logger().Error("unable to parse health check interval",
+				zap.String("container_id", c.ID),
+				zap.String("value", value),
+				zap.Error(err),
+			)
+			return healthCheck{}
+		}
+		check.interval = interval
+	}
+
+	if value, ok := c.Labels[LabelHealthStatus]; ok {
+		if !validHealthStatus(value) {
+			ctx.Logger().Error("unable to parse health check status",
+				zap.String("container_id", c.ID),
+				zap.String("value", value),
+			)
+			return healthCheck{}
+		}
+		check.status = value
+	}
+
+	return check
+}
+
+func validHealthStatus(status string) bool {
+	if len(status) != 3 {
+		return false
+	}
+	if class, ok := strings.CutSuffix(status, "xx"); ok {
+		return class >= "1" && class <= "5"
+	}
+	code, err := strconv.Atoi(status)
+	return err == nil && code >= 100 && code <= 599
+}
+
+// expects reports whether code is the status the check expects.
+func (h healthCheck) expects(code int) bool {
+	if class, ok := strings.CutSuffix(h.status, "xx"); ok {
+		return strconv.Itoa(code/100) == class
+	}
+	return strconv.Itoa(code) == h.status
+}
+
+// healthChecker actively probes the candidates of one block that carry a
+// health check, and remembers which of them are failing. Candidates are
+// healthy until a probe fails, and again as soon as one passes.
+type healthChecker struct {
+	tick time.Duration
+	tls  *tls.Config // for https probes; nil trusts the system roots
+
+	mu     sync.RWMutex
+	states map[string]*probeState // by container ID
+}
+
+type probeState struct {
+	failing bool
+	due     time.Time
+	busy    bool
+}
+
+type probe struct {
+	id      string
+	address string // dial address, as returned by dial
+	scheme  string
+	sni     string
+	tls     *tls.Config
+	check   healthCheck
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		tick:   healthCheckTick,
+		states: make(map[string]*probeState),
+	}
+}
+
+// failing reports whether the candidate's last probe failed.
+func (h *healthChecker) failing(id string) bool {
+	if h == nil {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	state, ok := h.states[id]
+	return ok && state.failing
+}
+
+// healthTLSConfig returns the TLS configuration of https probes, from the
+// health TLS options; nil when they are unset.
+func (u *Upstreams) healthTLSConfig() (*tls.Config, error) {
+	if len(u.HealthTLSTrustedCACerts) == 0 && !u.HealthTLSInsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: u.HealthTLSInsecureSkipVerify}
+	if len(u.HealthTLSTrustedCACerts) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		for _, file := range u.HealthTLSTrustedCACerts {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("reading health check CA certificates: %w", err)
+			}
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in health check CA file %s", file)
+			}
+		}
+	}
+	return config, nil
+}
+
+// checkHealth schedules the probes of this block's candidates on a fixed pool
+// of workers until ctx is done.
+func (u *Upstreams) checkHealth(ctx caddy.Context) {
+	probes := make(chan probe)
+	for range healthCheckWorkers {
+		go func() {
+			for p := range probes {
+				u.health.record(ctx, p, p.run(ctx))
+			}
+		}()
+	}
+	defer close(probes)
+
+	ticker := time.NewTicker(u.health.tick)
+	defer ticker.Stop()
+
+	for {
+		for _, p := range u.health.due(u.probes(), time.Now()) {
+			select {
+			case probes <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probes lists the probes for this block's candidates that carry a health
+// check, dialed the way this block dials them.
+func (u *Upstreams) probes() []probe {
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+
+	var out []probe
+	for _, c := range candidates {
+		if c.source != u.source || c.stopped || c.held != "" || c.health.path == "" || !u.selects(c) {
+			continue
+		}
+
+		address, ok := u.dial(c)
+		if !ok {
+			continue
+		}
+
+		out = append(out, probe{
+			id:      c.id,
+			address: address,
+			scheme:  c.scheme,
+			sni:     c.tlsServerName,
+			tls:     u.health.tls,
+			check:   c.health,
+		})
+	}
+	return out
+}
+
+// due returns the probes that should run now, marking them busy, and forgets
+// the containers that are no longer probed.
+func (h *healthChecker) due(probes []probe, now time.Time) []probe {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	present := make(map[string]bool, len(probes))
+	var out []probe
+	for _, p := range probes {
+		present[p.id] = true
+
+		state, ok := h.states[p.id]
+		if !ok {
+			state = &probeState{}
+			h.states[p.id] = state
+		}
+		if state.busy || now.Before(state.due) {
+			continue
+		}
+
+		state.busy = true
+		state.due = now.Add(p.check.interval)
+		out = append(out, p)
+	}
+
+	for id := range h.states {
+		if !present[id] {
+			delete(h.states, id)
+		}
+	}
+
+	return out
+}
+
+func (h *healthChecker) record(ctx caddy.Context, p probe, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, ok := h.states[p.id]
+	if !ok {
+		return
+	}
+	state.busy = false
+
+	failing := err != nil
+	if failing != state.failing {
+		if failing {
+			ctx.Logger().Warn("container failed health check",
+				zap.String("container_id", p.id),
+				zap.Error(err),
+			)
+		} else {
+			ctx.Logger().Info("container passed health check", zap.String("container_id", p.id))
+		}
+	}
+	state.failing = failing
+}
+
+// run performs the probe, returning why it failed.
+func (p probe) run(ctx context.Context) error {
+	transport := &http.Transport{DisableKeepAlives: true}
+
+	scheme, host := "http", p.address
+	if path, ok := strings.CutPrefix(p.address, "unix/"); ok {
+		host = "localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+	}
+	switch p.scheme {
+	case schemeHTTPS:
+		scheme = "https"
+		config := new(tls.Config)
+		if p.tls != nil {
+			config = p.tls.Clone()
+		}
+		config.ServerName = p.sni
+		transport.TLSClientConfig = config
+	case schemeH2C:
+		// An h2c backend, e.g. a gRPC server, may not speak HTTP/1 at all.
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	timeout := min(p.check.interval, defaultHealthTimeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+host+p.check.path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !p.check.expects(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d, want %s", resp.StatusCode, p.check.status)
+	}
+	return nil
+}
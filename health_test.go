@@ -0,0 +1,256 @@
+package caddy_docker_upstreams
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   healthCheck
+	}{
+		{
+			name: "no health labels",
+		},
+		{
+			name:   "defaults",
+			labels: map[string]string{LabelHealthPath: "/healthz"},
+			want:   healthCheck{path: "/healthz", interval: defaultHealthInterval, status: "2xx"},
+		},
+		{
+			name: "interval and status",
+			labels: map[string]string{
+				LabelHealthPath:     "/healthz",
+				LabelHealthInterval: "30s",
+				LabelHealthStatus:   "204",
+			},
+			want: healthCheck{path: "/healthz", interval: 30 * time.Second, status: "204"},
+		},
+		{
+			name:   "invalid interval disables the check",
+			labels: map[string]string{LabelHealthPath: "/healthz", LabelHealthInterval: "often"},
+		},
+		{
+			name:   "invalid status disables the check",
+			labels: map[string]string{LabelHealthPath: "/healthz", LabelHealthStatus: "ok"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseHealthCheck(newTestContext(t), container.Summary{ID: "a", Labels: tt.labels})
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHealthCheckExpects(t *testing.T) {
+	class := healthCheck{status: "2xx"}
+	assert.True(t, class.expects(http.StatusOK))
+	assert.True(t, class.expects(http.StatusNoContent))
+	assert.False(t, class.expects(http.StatusMovedPermanently))
+
+	exact := healthCheck{status: "204"}
+	assert.True(t, exact.expects(http.StatusNoContent))
+	assert.False(t, exact.expects(http.StatusOK))
+}
+
+// healthServer serves /healthz with 200, or 503 while failing is set.
+func healthServer(t *testing.T, failing *atomic.Bool) http.Handler {
+	t.Helper()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func TestProbeRun(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewServer(healthServer(t, &failing))
+	t.Cleanup(srv.Close)
+	address := srv.Listener.Addr().String()
+
+	check := healthCheck{path: "/healthz", interval: time.Second, status: "2xx"}
+	p := probe{id: "a", address: address, scheme: schemeHTTP, check: check}
+
+	assert.NoError(t, p.run(t.Context()))
+
+	failing.Store(true)
+	assert.Error(t, p.run(t.Context()))
+
+	p.check.status = "503"
+	assert.NoError(t, p.run(t.Context()))
+
+	p.check = healthCheck{path: "/missing", interval: time.Second, status: "2xx"}
+	assert.Error(t, p.run(t.Context()))
+}
+
+func TestProbeRunH2C(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewUnstartedServer(healthServer(t, &failing))
+	// Like a gRPC server, the backend speaks unencrypted HTTP/2 only.
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	address := srv.Listener.Addr().String()
+
+	check := healthCheck{path: "/healthz", interval: time.Second, status: "2xx"}
+
+	p := probe{id: "a", address: address, scheme: schemeH2C, check: check}
+	assert.NoError(t, p.run(t.Context()))
+
+	p.scheme = schemeHTTP
+	assert.Error(t, p.run(t.Context()), "an HTTP/1 probe must fail against an h2c-only backend")
+}
+
+func TestProbeRunHTTPS(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewTLSServer(healthServer(t, &failing))
+	t.Cleanup(srv.Close)
+	address := srv.Listener.Addr().String()
+
+	check := healthCheck{path: "/healthz", interval: time.Second, status: "2xx"}
+
+	// The test server's certificate is not signed by the system roots.
+	p := probe{id: "a", address: address, scheme: schemeHTTPS, check: check}
+	assert.Error(t, p.run(t.Context()))
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	}), 0o600))
+
+	trusted := Upstreams{HealthTLSTrustedCACerts: []string{ca}}
+	config, err := trusted.healthTLSConfig()
+	require.NoError(t, err)
+	p.tls = config
+	assert.NoError(t, p.run(t.Context()))
+
+	// The certificate is verified against the TLS server name.
+	p.sni = "other.test"
+	assert.Error(t, p.run(t.Context()))
+
+	insecure := Upstreams{HealthTLSInsecureSkipVerify: true}
+	p.tls, err = insecure.healthTLSConfig()
+	require.NoError(t, err)
+	assert.NoError(t, p.run(t.Context()))
+
+	p.check.status = "503"
+	assert.Error(t, p.run(t.Context()))
+}
+
+func TestHealthTLSConfig(t *testing.T) {
+	var u Upstreams
+	config, err := u.healthTLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, config, "without options, probes trust the system roots")
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(empty, nil, 0o600))
+
+	for _, file := range []string{empty, filepath.Join(t.TempDir(), "missing.pem")} {
+		u := Upstreams{HealthTLSTrustedCACerts: []string{file}}
+		_, err := u.healthTLSConfig()
+		assert.Error(t, err, file)
+	}
+}
+
+func TestProbeRunUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	var failing atomic.Bool
+	srv := &httptest.Server{Listener: ln, Config: &http.Server{Handler: healthServer(t, &failing)}}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	p := probe{
+		id:      "a",
+		address: "unix/" + path,
+		check:   healthCheck{path: "/healthz", interval: time.Second, status: "2xx"},
+	}
+	assert.NoError(t, p.run(t.Context()))
+}
+
+func TestHealthCheckerDue(t *testing.T) {
+	h := newHealthChecker()
+	now := time.Now()
+	check := healthCheck{path: "/healthz", interval: time.Minute, status: "2xx"}
+	probes := []probe{{id: "a", check: check}, {id: "b", check: check}}
+
+	assert.Len(t, h.due(probes, now), 2)
+	// Both are busy, and then not due before the interval elapses.
+	assert.Empty(t, h.due(probes, now))
+	h.record(newTestContext(t), probes[0], nil)
+	assert.Empty(t, h.due(probes, now.Add(time.Second)))
+	assert.Len(t, h.due(probes, now.Add(time.Minute)), 1)
+
+	// Containers that are no longer probed are forgotten.
+	h.due(probes[:1], now)
+	h.mu.RLock()
+	assert.NotContains(t, h.states, "b")
+	h.mu.RUnlock()
+}
+
+func TestCheckHealthKeepsFailingContainersOut(t *testing.T) {
+	withCandidates(t)
+	ctx, _ := newCancelableContext(t)
+
+	var failing atomic.Bool
+	srv := httptest.NewServer(healthServer(t, &failing))
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	check := healthCheck{path: "/healthz", interval: time.Millisecond, status: "2xx"}
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{id: "checked", address: target.Hostname(), port: target.Port(), health: check},
+		{id: "unchecked", address: "10.0.0.2", port: "8080"},
+	}
+	candidatesMu.Unlock()
+
+	u := &Upstreams{health: newHealthChecker()}
+	u.health.tick = time.Millisecond
+	go u.checkHealth(ctx)
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+	dials := func() []string {
+		got, err := u.GetUpstreams(req)
+		require.NoError(t, err)
+		return upstreamDials(got)
+	}
+
+	checked := net.JoinHostPort(target.Hostname(), target.Port())
+	assert.ElementsMatch(t, []string{checked, "10.0.0.2:8080"}, dials())
+
+	failing.Store(true)
+	require.Eventually(t, func() bool { return u.health.failing("checked") }, 2*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.2:8080"}, dials())
+
+	failing.Store(false)
+	require.Eventually(t, func() bool { return !u.health.failing("checked") }, 2*time.Second, time.Millisecond)
+	assert.ElementsMatch(t, []string{checked, "10.0.0.2:8080"}, dials())
+}
@@ -0,0 +1,221 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"go.uber.org/zap"
+)
+
+const LabelIdleStop = "com.caddyserver.http.idle_stop"
+
+const (
+	// defaultStartTimeout is how long a request waits for the stopped
+	// container it started, unless wait_for_upstream is set.
+	defaultStartTimeout = 30 * time.Second
+
+	idleCheckInterval = 10 * time.Second
+)
+
+var stoppedStatus = []string{string(container.StateExited), string(container.StateCreated)}
+
+// stoppedFilters returns the Docker API filters this block lists its stopped
+// scale-to-zero containers with: its own filters, for stopped containers
+// carrying the idle_stop label, whatever their health.
+func (u *Upstreams) stoppedFilters() client.Filters {
+	filters := u.filters()
+	delete(filters, "health")
+	delete(filters, "status")
+
+	status := stoppedStatus
+	if u.Engine == enginePodman {
+		status = append(slices.Clone(status), string(podmanStateStopped))
+	}
+	return filters.
+		Add("status", status...).
+		Add("label", u.label(LabelIdleStop))
+}
+
+// isStopped reports whether the container is one scale-to-zero may start.
+func isStopped(c container.Summary) bool {
+	switch c.State {
+	case container.StateExited, container.StateCreated, podmanStateStopped:
+		return true
+	}
+	return false
+}
+
+// parseIdleStop returns the container's idle_stop label, or zero if it
+// carries no valid one.
+func parseIdleStop(ctx caddy.Context, c container.Summary) time.Duration {
+	value, ok := c.Labels[LabelIdleStop]
+	if !ok {
+		return 0
+	}
+
+	idle, err := caddy.ParseDuration(value)
+	if err != nil || idle <= 0 {
+		ctx.Logger().Error("unable to parse idle stop",
+			zap.String("container_id", c.ID),
+			zap.String("value", value),
+			zap.Error(err),
+		)
+		return 0
+	}
+	return idle
+}
+
+// lastUsed records when each scale-to-zero container last had a request, and
+// inFlight how many requests that may be proxied to it are being served, by
+// container ID. A container's use counts whichever block serves it.
+var (
+	lastUsed   = make(map[string]time.Time)
+	inFlight   = make(map[string]int)
+	lastUsedMu sync.Mutex
+)
+
+// markUsed records the use of the scale-to-zero candidates among selected by
+// a request, until ctx, the request's context, is done. The reverse proxy
+// selects one of them later, so all of them count as in use meanwhile; a
+// WebSocket or streaming request keeps them in use for as long as it lasts.
+func markUsed(ctx context.Context, selected []candidate, now time.Time) {
+	lastUsedMu.Lock()
+	defer lastUsedMu.Unlock()
+
+	for _, c := range selected {
+		if c.idleStop <= 0 {
+			continue
+		}
+		lastUsed[c.id] = now
+		inFlight[c.id]++
+
+		context.AfterFunc(ctx, func() {
+			lastUsedMu.Lock()
+			defer lastUsedMu.Unlock()
+
+			lastUsed[c.id] = time.Now()
+			inFlight[c.id]--
+			if inFlight[c.id] <= 0 {
+				delete(inFlight, c.id)
+			}
+		})
+	}
+}
+
+// starting holds the containers being started, so concurrent requests start
+// each container once.
+var (
+	starting   = make(map[string]bool)
+	startingMu sync.Mutex
+)
+
+// startStopped starts the stopped candidates of this block the request
+// matches. It reports whether there were any, in which case the request may
+// wait for them.
+func (u *Upstreams) startStopped(r *http.Request) bool {
+	candidatesMu.RLock()
+	var ids []string
+	for _, c := range candidates {
+		if c.source == u.source && c.stopped && u.selects(c) && c.matchers.Match(r) {
+			ids = append(ids, c.id)
+		}
+	}
+	candidatesMu.RUnlock()
+
+	startingMu.Lock()
+	defer startingMu.Unlock()
+
+	for _, id := range ids {
+		if starting[id] {
+			continue
+		}
+		starting[id] = true
+
+		// The request that starts a container must not cancel its start.
+		go func() {
+			defer func() {
+				startingMu.Lock()
+				delete(starting, id)
+				startingMu.Unlock()
+			}()
+
+			_, err := u.client.ContainerStart(u.ctx, id, client.ContainerStartOptions{})
+			if err != nil {
+				u.ctx.Logger().Error("unable to start container", zap.String("container_id", id), zap.Error(err))
+				return
+			}
+			u.ctx.Logger().Info("started idle container", zap.String("container_id", id))
+		}()
+	}
+	return len(ids) > 0
+}
+
+// stopIdle stops the scale-to-zero containers of this block that went
+// without requests for their idle_stop duration, until ctx is done.
+func (u *Upstreams) stopIdle(ctx caddy.Context, cli dockerClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, id := range u.idle(time.Now()) {
+			_, err := cli.ContainerStop(ctx, id, client.ContainerStopOptions{})
+			if err != nil {
+				ctx.Logger().Error("unable to stop idle container", zap.String("container_id", id), zap.Error(err))
+				continue
+			}
+			ctx.Logger().Info("stopped idle container", zap.String("container_id", id))
+		}
+	}
+}
+
+// idle returns the running scale-to-zero candidates of this block that went
+// without requests for their idle_stop duration, and forgets them. A
+// candidate's idle time counts from when it is first seen running, or from
+// the end of its last request.
+func (u *Upstreams) idle(now time.Time) []string {
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+
+	lastUsedMu.Lock()
+	defer lastUsedMu.Unlock()
+
+	present := make(map[string]bool, len(candidates))
+	for _, c := range candidates {
+		present[c.id] = true
+	}
+	for id := range lastUsed {
+		if !present[id] {
+			delete(lastUsed, id)
+		}
+	}
+
+	var ids []string
+	for _, c := range candidates {
+		if c.source != u.source || c.stopped || c.idleStop <= 0 || inFlight[c.id] > 0 {
+			continue
+		}
+
+		last, ok := lastUsed[c.id]
+		if !ok {
+			lastUsed[c.id] = now
+			continue
+		}
+		if now.Sub(last) >= c.idleStop {
+			ids = append(ids, c.id)
+			delete(lastUsed, c.id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,211 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// withLastUsed saves and restores the package-level use record.
+func withLastUsed(t *testing.T) {
+	t.Helper()
+	lastUsedMu.Lock()
+	prev, prevInFlight := lastUsed, inFlight
+	lastUsed, inFlight = make(map[string]time.Time), make(map[string]int)
+	lastUsedMu.Unlock()
+	t.Cleanup(func() {
+		lastUsedMu.Lock()
+		lastUsed, inFlight = prev, prevInFlight
+		lastUsedMu.Unlock()
+	})
+}
+
+func TestStoppedFilters(t *testing.T) {
+	u := Upstreams{HealthPolicy: healthPolicyHealthyOnly, ScaleToZero: true}
+
+	filters := u.stoppedFilters()
+	assert.Equal(t, map[string]bool{"exited": true, "created": true}, filters["status"])
+	assert.NotContains(t, filters, "health")
+	assert.True(t, filters["label"][LabelIdleStop])
+	assert.True(t, filters["label"][LabelEnable+"=true"])
+
+	// Listing stopped containers makes a different partition.
+	plain := Upstreams{HealthPolicy: healthPolicyHealthyOnly}
+	assert.NotEqual(t, plain.discoveryKey(), u.discoveryKey())
+}
+
+func TestProvisionCandidatesKeepsStoppedContainers(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	u := Upstreams{ScaleToZero: true}
+
+	running := summary("running",
+		map[string]string{LabelUpstreamPort: "8080", LabelIdleStop: "5m"},
+		map[string]string{"bridge": "10.0.0.1"},
+	)
+	running.State = container.StateRunning
+	stopped := summary("stopped", map[string]string{LabelUpstreamPort: "8080", LabelIdleStop: "5m"}, nil)
+	stopped.State = container.StateExited
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+		Return(client.ContainerListResult{Items: []container.Summary{running}}, nil)
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{All: true, Filters: u.stoppedFilters()}).
+		Return(client.ContainerListResult{Items: []container.Summary{stopped}}, nil)
+
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+	cli.AssertExpectations(t)
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+	require.Len(t, candidates, 2)
+	assert.False(t, candidates[0].stopped)
+	assert.True(t, candidates[1].stopped)
+	assert.Equal(t, 5*time.Minute, candidates[1].idleStop)
+	assert.Empty(t, candidates[1].address)
+}
+
+func TestGetUpstreamsStartsStoppedContainer(t *testing.T) {
+	withCandidates(t)
+	withLastUsed(t)
+
+	host := caddyhttp.MatchHost{"tools.example.com"}
+	require.NoError(t, host.Provision(newTestContext(t)))
+	matchers := caddyhttp.MatcherSet{&host}
+
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "tool", port: "8080", matchers: matchers, stopped: true, idleStop: time.Minute}}
+	candidatesMu.Unlock()
+
+	// Starting the container is followed by a refresh finding it running.
+	cli := &mockDockerClient{}
+	cli.On("ContainerStart", mock.Anything, "tool", client.ContainerStartOptions{}).
+		Run(func(mock.Arguments) {
+			candidatesMu.Lock()
+			candidates = []candidate{{id: "tool", address: "10.0.0.1", port: "8080", matchers: matchers, idleStop: time.Minute}}
+			notifyChanged()
+			candidatesMu.Unlock()
+		}).
+		Return(client.ContainerStartResult{}, nil).Once()
+
+	u := Upstreams{ScaleToZero: true, ctx: newTestContext(t), client: cli}
+
+	got, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://tools.example.com/"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, upstreamDials(got))
+	cli.AssertExpectations(t)
+
+	lastUsedMu.Lock()
+	_, used := lastUsed["tool"]
+	lastUsedMu.Unlock()
+	assert.True(t, used, "expected the request to count as a use")
+
+	// Requests for other hosts leave stopped containers alone.
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "tool", port: "8080", matchers: matchers, stopped: true, idleStop: time.Minute}}
+	candidatesMu.Unlock()
+
+	req := newRequest(t, http.MethodGet, "http://other.example.com/")
+	got, err = u.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestIdle(t *testing.T) {
+	withCandidates(t)
+	withLastUsed(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{id: "idle", idleStop: time.Minute},
+		{id: "busy", idleStop: time.Minute},
+		{id: "stopped", idleStop: time.Minute, stopped: true},
+		{id: "always-on"},
+	}
+	candidatesMu.Unlock()
+
+	var u Upstreams
+	start := time.Now()
+
+	// Running containers are first seen, not stopped right away.
+	assert.Empty(t, u.idle(start))
+
+	ctx, done := context.WithCancel(context.Background())
+	markUsed(ctx, []candidate{{id: "busy", idleStop: time.Minute}}, start.Add(30*time.Second))
+	assert.Equal(t, []string{"idle"}, u.idle(start.Add(time.Minute)))
+
+	// A request still in flight, e.g. a WebSocket, keeps the container.
+	assert.Empty(t, u.idle(start.Add(time.Hour)))
+
+	done()
+	require.Eventually(t, func() bool {
+		lastUsedMu.Lock()
+		defer lastUsedMu.Unlock()
+		return inFlight["busy"] == 0
+	}, 2*time.Second, time.Millisecond)
+
+	// Its idle time counts from the end of the request.
+	ended := time.Now()
+	assert.Empty(t, u.idle(ended.Add(30*time.Second)))
+	assert.Equal(t, []string{"busy"}, u.idle(ended.Add(2*time.Minute)))
+}
+
+func TestGetUpstreamsMarksUseWithoutScaleToZero(t *testing.T) {
+	withCandidates(t)
+	withLastUsed(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "tool", address: "10.0.0.1", port: "8080", idleStop: time.Minute}}
+	candidatesMu.Unlock()
+
+	// Another block serving the container without scale_to_zero still
+	// keeps it in use.
+	var u Upstreams
+	_, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://example.com/"))
+	require.NoError(t, err)
+
+	lastUsedMu.Lock()
+	defer lastUsedMu.Unlock()
+	assert.Contains(t, lastUsed, "tool")
+	assert.Equal(t, 1, inFlight["tool"])
+}
+
+func TestStopIdleStopsContainers(t *testing.T) {
+	withCandidates(t)
+	withLastUsed(t)
+	ctx, _ := newCancelableContext(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "idle", idleStop: time.Millisecond}}
+	candidatesMu.Unlock()
+
+	stopped := make(chan string, 1)
+	cli := &mockDockerClient{}
+	cli.On("ContainerStop", mock.Anything, "idle", client.ContainerStopOptions{}).
+		Run(func(args mock.Arguments) {
+			select {
+			case stopped <- args.String(1):
+			default:
+			}
+		}).
+		Return(client.ContainerStopResult{}, nil)
+
+	var u Upstreams
+	go u.stopIdle(ctx, cli, time.Millisecond)
+
+	select {
+	case id := <-stopped:
+		assert.Equal(t, "idle", id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle container was not stopped")
+	}
+}
@@ -0,0 +1,48 @@
+package caddy_docker_upstreams
+
+import "strings"
+
+// DefaultLabelPrefix namespaces the labels this module reads, unless a block
+// configures another prefix.
+const DefaultLabelPrefix = "com.caddyserver.http"
+
+// labelPrefix returns the prefix of the labels this block reads, without a
+// trailing dot.
+func (u *Upstreams) labelPrefix() string {
+	prefix := strings.TrimSuffix(u.LabelPrefix, ".")
+	if prefix == "" {
+		return DefaultLabelPrefix
+	}
+	return prefix
+}
+
+// label returns the name this block reads the given Label* constant under.
+func (u *Upstreams) label(name string) string {
+	suffix := strings.TrimPrefix(name, DefaultLabelPrefix+".")
+	return u.labelPrefix() + "." + suffix
+}
+
+// moduleLabels returns the container labels as this block reads them: its
+// own labels renamed to their default names, so they can be looked up with
+// the Label* constants, and other labels unchanged. Labels under the default
+// prefix belong to other instances and are dropped.
+func (u *Upstreams) moduleLabels(labels map[string]string) map[string]string {
+	prefix := u.labelPrefix()
+	if prefix == DefaultLabelPrefix {
+		return labels
+	}
+
+	out := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if strings.HasPrefix(key, DefaultLabelPrefix+".") || strings.HasPrefix(key, prefix+".") {
+			continue
+		}
+		out[key] = value
+	}
+	for key, value := range labels {
+		if suffix, ok := strings.CutPrefix(key, prefix+"."); ok {
+			out[DefaultLabelPrefix+"."+suffix] = value
+		}
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabel(t *testing.T) {
+	var u Upstreams
+	assert.Equal(t, LabelEnable, u.label(LabelEnable))
+	assert.Equal(t, LabelMatchHost, u.label(LabelMatchHost))
+
+	u.LabelPrefix = "com.example.internal"
+	assert.Equal(t, "com.example.internal.enable", u.label(LabelEnable))
+	assert.Equal(t, "com.example.internal.matchers.host", u.label(LabelMatchHost))
+
+	u.LabelPrefix = "com.example.internal."
+	assert.Equal(t, "com.example.internal.enable", u.label(LabelEnable))
+}
+
+func TestModuleLabels(t *testing.T) {
+	labels := map[string]string{
+		"com.docker.compose.service":         "web",
+		LabelUpstreamPort:                    "80",
+		LabelMatchHost:                       "public.example.com",
+		"com.example.internal.enable":        "true",
+		"com.example.internal.upstream.port": "8080",
+		"com.example.internal.matchers.host": "internal.example.com",
+	}
+
+	var u Upstreams
+	assert.Equal(t, labels, u.moduleLabels(labels), "the default prefix reads labels as they are")
+
+	u.LabelPrefix = "com.example.internal"
+	assert.Equal(t, map[string]string{
+		"com.docker.compose.service": "web",
+		LabelEnable:                  "true",
+		LabelUpstreamPort:            "8080",
+		LabelMatchHost:               "internal.example.com",
+	}, u.moduleLabels(labels))
+}
+
+func TestLabelPrefixFilters(t *testing.T) {
+	u := Upstreams{LabelPrefix: "com.example.internal"}
+	assert.Equal(t, map[string]bool{"com.example.internal.enable=true": true}, u.filters()["label"])
+
+	var other Upstreams
+	assert.NotEqual(t, u.discoveryKey(), other.discoveryKey())
+}
+
+func TestProvisionCandidatesLabelPrefix(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	// One container serves both instances, on different ports and hosts.
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{
+			summary("a",
+				map[string]string{
+					"com.docker.compose.service":         "web",
+					LabelUpstreamPort:                    "80",
+					LabelMatchHost:                       "public.example.com",
+					"com.example.internal.upstream.port": "8080",
+					"com.example.internal.matchers.host": "internal.example.com",
+				},
+				map[string]string{"bridge": "10.0.0.1"},
+			),
+		}}, nil)
+
+	u := Upstreams{LabelPrefix: "com.example.internal", Labels: map[string][]string{
+		"com.docker.compose.service": {"web"},
+	}}
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	got, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://internal.example.com/"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, upstreamDials(got))
+
+	got, err = u.GetUpstreams(newRequest(t, http.MethodGet, "http://public.example.com/"))
+	require.NoError(t, err)
+	assert.Empty(t, got, "the default-prefixed matchers belong to the other instance")
+}
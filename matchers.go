@@ -6,6 +6,7 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/moby/moby/api/types/container"
 	"go.uber.org/zap"
 )
 
@@ -48,15 +49,31 @@ var producers = map[string]func(string) (caddyhttp.RequestMatcherWithError, erro
 	},
 }
 
-func buildMatchers(ctx caddy.Context, labels map[string]string) caddyhttp.MatcherSet {
+// buildMatchers builds the matchers of the container from its matcher
+// labels, after expanding the container templates in their values. It
+// reports false when a template cannot be expanded: without that matcher the
+// container would serve requests the label meant to exclude, so it must not
+// be served at all.
+func buildMatchers(ctx caddy.Context, c container.Summary) (caddyhttp.MatcherSet, bool) {
 	var matchers caddyhttp.MatcherSet
 
 	for key, producer := range producers {
-		value, ok := labels[key]
+		value, ok := c.Labels[key]
 		if !ok {
 			continue
 		}
 
+		value, err := expandTemplate(value, c)
+		if err != nil {
+			ctx.Logger().Error("unable to expand matcher template",
+				zap.String("id", c.ID),
+				zap.String("key", key),
+				zap.String("value", c.Labels[key]),
+				zap.Error(err),
+			)
+			return nil, false
+		}
+
 		matcher, err := producer(value)
 		if err != nil {
 			ctx.Logger().Error("unable to load matcher",
@@ -82,5 +99,5 @@ func buildMatchers(ctx caddy.Context, labels map[string]string) caddyhttp.Matche
 		matchers = append(matchers, matcher)
 	}
 
-	return matchers
+	return matchers, true
 }
@@ -7,7 +7,10 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -144,7 +147,8 @@ func TestBuildMatchers(t *testing.T) {
 		LabelEnable: "true",
 	}
 
-	matchers := buildMatchers(ctx, labels)
+	matchers, ok := buildMatchers(ctx, container.Summary{Labels: labels})
+	require.True(t, ok)
 	require.Len(t, matchers, 3)
 
 	ok, err := matchers.MatchWithError(newRequest(t, http.MethodGet, "http://example.com/api/users"))
@@ -160,7 +164,8 @@ func TestBuildMatchers(t *testing.T) {
 func TestBuildMatchersEmpty(t *testing.T) {
 	ctx := newTestContext(t)
 
-	matchers := buildMatchers(ctx, map[string]string{"unrelated": "label"})
+	matchers, ok := buildMatchers(ctx, container.Summary{Labels: map[string]string{"unrelated": "label"}})
+	require.True(t, ok)
 	require.Empty(t, matchers)
 
 	// An empty matcher set matches every request.
@@ -169,4 +174,59 @@ func TestBuildMatchersEmpty(t *testing.T) {
 	assert.True(t, ok, "expected empty matcher set to match any request")
 }
 
+func TestBuildMatchersExpandsTemplates(t *testing.T) {
+	ctx := newTestContext(t)
+
+	matchers, ok := buildMatchers(ctx, container.Summary{
+		Names: []string{"/app-api-2"},
+		Labels: map[string]string{
+			LabelMatchHost: "{container.name}.example.com",
+			LabelMatchPath: "/api/*",
+		},
+	})
+	require.True(t, ok)
+	require.Len(t, matchers, 2)
+
+	ok, err := matchers.MatchWithError(newRequest(t, http.MethodGet, "http://app-api-2.example.com/api/users"))
+	require.NoError(t, err)
+	assert.True(t, ok, "expected request to the container's host to match")
+
+	ok, err = matchers.MatchWithError(newRequest(t, http.MethodGet, "http://app-api-1.example.com/api/users"))
+	require.NoError(t, err)
+	assert.False(t, ok, "expected request to another host not to match")
+}
+
+func TestBuildMatchersRejectsUnexpandedTemplates(t *testing.T) {
+	ctx := newTestContext(t)
+
+	_, ok := buildMatchers(ctx, container.Summary{
+		Labels: map[string]string{
+			LabelMatchHost: "example.com",
+			LabelMatchPath: "/{label.missing}/*",
+		},
+	})
+	assert.False(t, ok, "a container whose matcher cannot be built must not be served")
+}
+
+func TestProvisionCandidatesSkipsUnexpandedTemplates(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	var u Upstreams
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+		Return(client.ContainerListResult{Items: []container.Summary{
+			// No Compose labels to fill the template with.
+			summary("loose",
+				map[string]string{LabelUpstreamPort: "80", LabelMatchHost: "{compose.service}.example.com"},
+				map[string]string{"bridge": "10.0.0.1"},
+			),
+		}}, nil)
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	got, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://anything.other.com/"))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
 var _ caddyhttp.RequestMatcherWithError = (caddyhttp.MatcherSet)(nil)
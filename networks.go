@@ -0,0 +1,90 @@
+package caddy_docker_upstreams
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/moby/moby/client"
+	"go.uber.org/zap"
+)
+
+// autoConnected records the networks this module attached Caddy's container
+// to. Only these are ever detached again, which keeps the networks Caddy was
+// started with out of reach of the reconciliation.
+var (
+	autoConnected   = make(map[string]bool)
+	autoConnectedMu sync.Mutex
+)
+
+// selfNetworks returns the names of the networks Caddy's own container is
+// currently attached to.
+func (u *Upstreams) selfNetworks(ctx caddy.Context, cli dockerClient) (map[string]bool, error) {
+	res, err := cli.ContainerInspect(ctx, u.Container, client.ContainerInspectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("inspecting caddy container: %w", err)
+	}
+
+	attached := make(map[string]bool)
+	if res.Container.NetworkSettings != nil {
+		for name := range res.Container.NetworkSettings.Networks {
+			attached[name] = true
+		}
+	}
+	return attached, nil
+}
+
+// connectNetworks attaches Caddy's container to every network a candidate is
+// reached through, and detaches it from the networks it attached earlier that
+// no candidate uses any more. Failures are logged rather than returned so one
+// network cannot hold back the others.
+func (u *Upstreams) connectNetworks(ctx caddy.Context, cli dockerClient, attached map[string]bool, cs []candidate) {
+	used := make(map[string]bool, len(cs))
+	for _, c := range cs {
+		switch c.network {
+		case "", "host", "none":
+			// Nothing to attach to.
+		default:
+			used[c.network] = true
+		}
+	}
+
+	autoConnectedMu.Lock()
+	defer autoConnectedMu.Unlock()
+
+	for network := range used {
+		if attached[network] {
+			continue
+		}
+
+		_, err := cli.NetworkConnect(ctx, network, client.NetworkConnectOptions{Container: u.Container})
+		if err != nil {
+			ctx.Logger().Error("unable to connect caddy to network",
+				zap.String("network", network),
+				zap.Error(err),
+			)
+			continue
+		}
+		ctx.Logger().Info("connected caddy to network", zap.String("network", network))
+		autoConnected[network] = true
+	}
+
+	for network := range autoConnected {
+		if used[network] {
+			continue
+		}
+
+		if attached[network] {
+			_, err := cli.NetworkDisconnect(ctx, network, client.NetworkDisconnectOptions{Container: u.Container})
+			if err != nil {
+				ctx.Logger().Error("unable to disconnect caddy from network",
+					zap.String("network", network),
+					zap.Error(err),
+				)
+				continue
+			}
+			ctx.Logger().Info("disconnected caddy from network", zap.String("network", network))
+		}
+		delete(autoConnected, network)
+	}
+}
@@ -0,0 +1,125 @@
+package caddy_docker_upstreams
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// withAutoConnected saves and restores the package-level record of networks
+// this module attached Caddy to.
+func withAutoConnected(t *testing.T) {
+	t.Helper()
+	autoConnectedMu.Lock()
+	prev := autoConnected
+	autoConnected = make(map[string]bool)
+	autoConnectedMu.Unlock()
+	t.Cleanup(func() {
+		autoConnectedMu.Lock()
+		autoConnected = prev
+		autoConnectedMu.Unlock()
+	})
+}
+
+// inspectResult is a canned ContainerInspect response for Caddy's container
+// attached to the given networks.
+func inspectResult(networks ...string) client.ContainerInspectResult {
+	nets := make(map[string]*network.EndpointSettings, len(networks))
+	for _, name := range networks {
+		nets[name] = &network.EndpointSettings{}
+	}
+	return client.ContainerInspectResult{Container: container.InspectResponse{
+		NetworkSettings: &container.NetworkSettings{Networks: nets},
+	}}
+}
+
+func TestAutoConnect(t *testing.T) {
+	withCandidates(t)
+	withAutoConnected(t)
+	ctx := newTestContext(t)
+
+	backend := summary("a",
+		map[string]string{LabelUpstreamPort: "8080", LabelNetwork: "backend"},
+		map[string]string{"backend": "172.20.0.5"},
+	)
+	u := &Upstreams{AutoConnect: true, Container: "caddy"}
+	self := client.NetworkConnectOptions{Container: "caddy"}
+
+	// The backend is discovered on a network Caddy is not attached to.
+	cli := &mockDockerClient{}
+	cli.On("ContainerInspect", mock.Anything, "caddy", mock.Anything).Return(inspectResult("bridge"), nil)
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{backend}}, nil)
+	cli.On("NetworkConnect", mock.Anything, "backend", self).Return(client.NetworkConnectResult{}, nil).Once()
+
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+	cli.AssertExpectations(t)
+
+	// Already attached: a refresh must not connect again.
+	cli = &mockDockerClient{}
+	cli.On("ContainerInspect", mock.Anything, "caddy", mock.Anything).Return(inspectResult("bridge", "backend"), nil)
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{backend}}, nil)
+
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+	cli.AssertNotCalled(t, "NetworkConnect", mock.Anything, mock.Anything, mock.Anything)
+
+	// The backend is gone: Caddy is detached from the network it was
+	// attached to, but never from the network it started with.
+	cli = &mockDockerClient{}
+	cli.On("ContainerInspect", mock.Anything, "caddy", mock.Anything).Return(inspectResult("bridge", "backend"), nil)
+	cli.On("ContainerList", mock.Anything, mock.Anything).Return(client.ContainerListResult{}, nil)
+	cli.On("NetworkDisconnect", mock.Anything, "backend", client.NetworkDisconnectOptions{Container: "caddy"}).
+		Return(client.NetworkDisconnectResult{}, nil).Once()
+
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+	cli.AssertExpectations(t)
+	cli.AssertNotCalled(t, "NetworkDisconnect", mock.Anything, "bridge", mock.Anything)
+	assert.Empty(t, autoConnected)
+}
+
+func TestAutoConnectPrefersAttachedNetwork(t *testing.T) {
+	withCandidates(t)
+	withAutoConnected(t)
+	ctx := newTestContext(t)
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerInspect", mock.Anything, "caddy", mock.Anything).Return(inspectResult("shared"), nil)
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{
+			summary("a",
+				map[string]string{LabelUpstreamPort: "8080"},
+				map[string]string{"private": "10.0.0.1", "shared": "10.0.1.1"},
+			),
+		}}, nil)
+
+	u := &Upstreams{AutoConnect: true, Container: "caddy"}
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+	assert.Equal(t, []string{"10.0.1.1:8080"}, dials(candidates))
+	cli.AssertNotCalled(t, "NetworkConnect", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestAutoConnectInspectError(t *testing.T) {
+	withCandidates(t)
+	withAutoConnected(t)
+	ctx := newTestContext(t)
+
+	sentinel := errors.New("boom")
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, mock.Anything).Return(client.ContainerListResult{}, nil)
+	cli.On("ContainerInspect", mock.Anything, "caddy", mock.Anything).
+		Return(client.ContainerInspectResult{}, sentinel)
+
+	u := &Upstreams{AutoConnect: true, Container: "caddy"}
+	err := u.provisionCandidates(ctx, cli)
+	assert.ErrorIs(t, err, sentinel)
+}
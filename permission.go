@@ -0,0 +1,73 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(Permission{})
+}
+
+// Permission allows on-demand TLS certificates only for the hosts the
+// discovered containers declare with the matchers.host label, so on-demand
+// TLS needs no ask endpoint. It checks the candidates of every dynamic
+// docker block, as they currently are.
+type Permission struct{}
+
+func (Permission) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.permission.docker",
+		New: func() caddy.Module { return new(Permission) },
+	}
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+//
+//	permission docker
+func (p *Permission) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// CertificateAllowed returns nil if a candidate's host matcher matches name.
+func (p Permission) CertificateAllowed(ctx context.Context, name string) error {
+	// Host matchers read the request's host and replacer only.
+	r := &http.Request{Host: name, URL: &url.URL{}}
+	r = r.WithContext(context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer()))
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+
+	for _, c := range candidates {
+		for _, m := range c.matchers {
+			host, ok := m.(*caddyhttp.MatchHost)
+			if !ok {
+				continue
+			}
+			match, err := host.MatchWithError(r)
+			if err == nil && match {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%s: %w: no container declares the host", name, caddytls.ErrPermissionDenied)
+}
+
+// Interface guards
+var (
+	_ caddytls.OnDemandPermission = (*Permission)(nil)
+	_ caddyfile.Unmarshaler       = (*Permission)(nil)
+)
@@ -0,0 +1,39 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermissionCertificateAllowed(t *testing.T) {
+	withCandidates(t)
+
+	hosts := caddyhttp.MatchHost{"example.com", "*.apps.example.com"}
+	path := caddyhttp.MatchPath{"/api/*"}
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{source: "a", matchers: caddyhttp.MatcherSet{&hosts, &path}},
+		// Matches any host, but declares none.
+		{source: "b", matchers: caddyhttp.MatcherSet{}},
+	}
+	candidatesMu.Unlock()
+
+	var p Permission
+	for _, name := range []string{"example.com", "EXAMPLE.com", "web.apps.example.com"} {
+		assert.NoError(t, p.CertificateAllowed(context.Background(), name), name)
+	}
+	for _, name := range []string{"other.com", "www.example.com", "a.b.apps.example.com", "127.0.0.1"} {
+		assert.ErrorIs(t, p.CertificateAllowed(context.Background(), name), caddytls.ErrPermissionDenied, name)
+	}
+}
+
+func TestUnmarshalCaddyfilePermission(t *testing.T) {
+	var p Permission
+	assert.NoError(t, p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`docker`)))
+	assert.Error(t, p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`docker example.com`)))
+}
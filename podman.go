@@ -0,0 +1,146 @@
+package caddy_docker_upstreams
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/client"
+)
+
+const (
+	engineDocker = "docker"
+	enginePodman = "podman"
+)
+
+// podmanStateStopped is the state of a Podman container that was stopped but
+// not yet cleaned up. Docker has no such state.
+const podmanStateStopped container.ContainerState = "stopped"
+
+// podmanRootfulSocket is where a rootful Podman serves its API.
+const podmanRootfulSocket = "/run/podman/podman.sock"
+
+// clientOptions returns the options the Docker client is created with. The
+// environment configures it as for the docker CLI; for Podman, without
+// DOCKER_HOST, it connects to the host in CONTAINER_HOST or the Podman
+// socket found on the host.
+func (u *Upstreams) clientOptions() []client.Opt {
+	opts := []client.Opt{client.FromEnv}
+	if u.Engine != enginePodman || os.Getenv(client.EnvOverrideHost) != "" {
+		return opts
+	}
+	if host := podmanHost(); host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	return opts
+}
+
+// podmanHost returns the host of the Podman API: CONTAINER_HOST, else the
+// rootless socket of the user, else the rootful one. It returns "" when no
+// socket exists, leaving the Docker default.
+func podmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+
+	var sockets []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	sockets = append(sockets, podmanRootfulSocket)
+
+	for _, socket := range sockets {
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+	}
+	return ""
+}
+
+// listedHealth reads the health of a listed container. Podman, and older
+// Docker daemons, report it in the status text only, e.g. "Up 2 minutes
+// (healthy)".
+func listedHealth(c container.Summary) container.HealthStatus {
+	if c.Health != nil && c.Health.Status != "" {
+		return c.Health.Status
+	}
+
+	switch {
+	case strings.HasSuffix(c.Status, "(healthy)"):
+		return container.Healthy
+	case strings.HasSuffix(c.Status, "(unhealthy)"):
+		return container.Unhealthy
+	case strings.HasSuffix(c.Status, "(starting)"), strings.HasSuffix(c.Status, "(health: starting)"):
+		return container.Starting
+	}
+	return container.NoHealthcheck
+}
+
+// admitsHealth reports whether the health policy admits a listed container,
+// for lists not filtered on health; see healthInCode.
+func (u *Upstreams) admitsHealth(c container.Summary) bool {
+	switch health := listedHealth(c); u.HealthPolicy {
+	case healthPolicyHealthyOnly:
+		return health == container.Healthy
+	case "", healthPolicyHealthyOrNone:
+		return health == container.Healthy || health == container.NoHealthcheck
+	case healthPolicyIncludeStarting:
+		return health != container.Unhealthy
+	}
+	return true
+}
+
+// podmanUserNetwork reports whether a Podman container runs in a rootless user
+// mode network, where it has no address of its own and is reached through
+// its published ports.
+func podmanUserNetwork(c container.Summary) bool {
+	switch c.HostConfig.NetworkMode {
+	case "pasta", "slirp4netns":
+		return true
+	}
+	if c.NetworkSettings == nil {
+		return true
+	}
+	for _, settings := range c.NetworkSettings.Networks {
+		if settings != nil && settings.IPAddress.IsValid() {
+			return false
+		}
+	}
+	return true
+}
+
+// podmanEvents drops the events of a Podman event stream that do not change
+// the candidates: Podman reports every health check run, and the execs and
+// cleanups around it, where Docker reports health changes only.
+type podmanEvents struct {
+	health map[string]string // last health status by container ID
+}
+
+func newPodmanEvents() *podmanEvents {
+	return &podmanEvents{health: make(map[string]string)}
+}
+
+// relevant reports whether the event may change the candidates.
+func (p *podmanEvents) relevant(msg events.Message) bool {
+	action := string(msg.Action)
+	switch {
+	case strings.HasPrefix(action, "exec"), action == "cleanup", action == "sync", action == "init":
+		return false
+	case action == "remove", action == "destroy":
+		delete(p.health, msg.Actor.ID)
+		return true
+	case strings.HasPrefix(action, string(events.ActionHealthStatus)):
+		status := msg.Actor.Attributes["health_status"]
+		if status == "" {
+			status = strings.TrimSpace(strings.TrimPrefix(action, string(events.ActionHealthStatus)+":"))
+		}
+		if p.health[msg.Actor.ID] == status {
+			return false
+		}
+		p.health[msg.Actor.ID] = status
+		return true
+	}
+	return true
+}
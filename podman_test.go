@@ -0,0 +1,188 @@
+package caddy_docker_upstreams
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// podmanContainers decodes a sample container list in the shape of Podman's
+// Docker compatible API responses.
+func podmanContainers(t *testing.T) []container.Summary {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", "podman", "containers.json"))
+	require.NoError(t, err)
+
+	var containers []container.Summary
+	require.NoError(t, json.Unmarshal(raw, &containers))
+	return containers
+}
+
+// podmanEventMessages decodes a sample event stream in the shape of Podman's
+// Docker compatible API responses.
+func podmanEventMessages(t *testing.T) []events.Message {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "podman", "events.json"))
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	var messages []events.Message
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var msg events.Message
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &msg))
+		messages = append(messages, msg)
+	}
+	require.NoError(t, scanner.Err())
+	return messages
+}
+
+func TestPodmanFilters(t *testing.T) {
+	u := Upstreams{Engine: enginePodman}
+	filters := u.filters()
+	assert.NotContains(t, filters, "health")
+	assert.Equal(t, map[string]bool{"running": true}, filters["status"])
+
+	docker := Upstreams{HealthPolicy: healthPolicyAny}
+	assert.NotEqual(t, docker.discoveryKey(), u.discoveryKey())
+
+	u.ScaleToZero = true
+	assert.True(t, u.stoppedFilters()["status"]["stopped"])
+}
+
+func TestProvisionCandidatesPodman(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	u := Upstreams{Engine: enginePodman}
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+		Return(client.ContainerListResult{Items: podmanContainers(t)}, nil)
+
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+	cli.AssertExpectations(t)
+
+	candidatesMu.RLock()
+	got := candidates
+	candidatesMu.RUnlock()
+
+	// The starting and unhealthy containers are left out.
+	require.Len(t, got, 2)
+
+	whoami := got[candidateIndex(got, "whoami")]
+	assert.Equal(t, "10.89.0.2", whoami.address)
+	assert.Equal(t, "demo_default", whoami.network)
+	assert.Len(t, whoami.matchers, 1)
+
+	// The rootless container has no address of its own, only a published
+	// port.
+	metrics := got[candidateIndex(got, "metrics")]
+	assert.Empty(t, metrics.address)
+	assert.Contains(t, metrics.published, "9091")
+
+	req := newRequest(t, http.MethodGet, "http://whoami.example.com/")
+	ups, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.89.0.2:80"}, upstreamDials(ups))
+
+	published := Upstreams{Engine: enginePodman, AddressMode: addressModePublished}
+	published.source = u.source
+	ups, err = published.GetUpstreams(newRequest(t, http.MethodGet, "http://metrics.example.com/"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:19091"}, upstreamDials(ups))
+}
+
+// candidateIndex returns the index of the candidate with the container name.
+func candidateIndex(cs []candidate, name string) int {
+	for i, c := range cs {
+		if len(c.names) > 0 && c.names[0] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPodmanHealth(t *testing.T) {
+	tests := []struct {
+		status string
+		want   container.HealthStatus
+	}{
+		{status: "Up 2 hours (healthy)", want: container.Healthy},
+		{status: "Up 1 hour (unhealthy)", want: container.Unhealthy},
+		{status: "Up 4 seconds (starting)", want: container.Starting},
+		{status: "Up 4 seconds (health: starting)", want: container.Starting},
+		{status: "Up 3 hours", want: container.NoHealthcheck},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			assert.Equal(t, tt.want, listedHealth(container.Summary{Status: tt.status}))
+		})
+	}
+
+	// A reported health takes precedence over the status text.
+	c := container.Summary{Status: "Up 2 hours", Health: &container.HealthSummary{Status: container.Unhealthy}}
+	assert.Equal(t, container.Unhealthy, listedHealth(c))
+}
+
+func TestPodmanEventsRelevant(t *testing.T) {
+	p := newPodmanEvents()
+
+	var relevant []events.Action
+	for _, msg := range podmanEventMessages(t) {
+		if p.relevant(msg) {
+			relevant = append(relevant, msg.Action)
+		}
+	}
+
+	// Repeated health checks, execs and cleanups do not refresh the
+	// candidates; health changes and lifecycle events do.
+	assert.Equal(t, []events.Action{"health_status", "health_status", "kill", "died", "remove"}, relevant)
+	assert.NotContains(t, p.health, "3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f")
+}
+
+func TestPodmanHost(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	t.Setenv("CONTAINER_HOST", "")
+
+	socket := filepath.Join(dir, "podman", "podman.sock")
+	require.NoError(t, os.MkdirAll(filepath.Dir(socket), 0o700))
+	require.NoError(t, os.WriteFile(socket, nil, 0o600))
+	assert.Equal(t, "unix://"+socket, podmanHost())
+
+	t.Setenv("CONTAINER_HOST", "tcp://podman.internal:8080")
+	assert.Equal(t, "tcp://podman.internal:8080", podmanHost())
+}
+
+func TestPodmanClientOptions(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("CONTAINER_HOST", "unix:///run/user/1000/podman/podman.sock")
+
+	docker := Upstreams{}
+	assert.Len(t, docker.clientOptions(), 1)
+
+	podman := Upstreams{Engine: enginePodman}
+	assert.Len(t, podman.clientOptions(), 2)
+
+	// DOCKER_HOST configures the client for either engine.
+	t.Setenv("DOCKER_HOST", "unix:///var/run/docker.sock")
+	assert.Len(t, podman.clientOptions(), 1)
+}
+
+func TestValidateEngine(t *testing.T) {
+	assert.NoError(t, (&Upstreams{Engine: enginePodman, Status: []string{"running", "stopped"}}).Validate())
+	assert.Error(t, (&Upstreams{Status: []string{"stopped"}}).Validate())
+	assert.Error(t, (&Upstreams{Engine: "containerd"}).Validate())
+}
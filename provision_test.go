@@ -3,6 +3,7 @@ package caddy_docker_upstreams
 import (
 	"errors"
 	"net"
+	"net/http"
 	"net/netip"
 	"testing"
 
@@ -44,10 +45,15 @@ func summary(id string, labels map[string]string, networks map[string]string) co
 
 // dials renders each candidate as the address it would be dialed at when its
 // port comes from the label; a candidate without a port label shows just the
-// IP, since its effective port is supplied per block in GetUpstreams.
+// IP, since its effective port is supplied per block in GetUpstreams. Socket
+// candidates render as their unix/ dial address.
 func dials(cs []candidate) []string {
 	out := make([]string, len(cs))
 	for i, c := range cs {
+		if c.unix != "" {
+			out[i] = "unix/" + c.unix
+			continue
+		}
 		out[i] = c.address
 		if c.port != "" {
 			out[i] = net.JoinHostPort(c.address, c.port)
@@ -142,6 +148,16 @@ func TestProvisionCandidates(t *testing.T) {
 			},
 			wantDials: []string{},
 		},
+		{
+			name: "unix socket container needs no network",
+			containers: []container.Summary{
+				summary("a",
+					map[string]string{LabelUpstreamUnix: "/run/app/app.sock"},
+					map[string]string{},
+				),
+			},
+			wantDials: []string{"unix//run/app/app.sock"},
+		},
 		{
 			name: "containers with and without a port label are both kept",
 			containers: []container.Summary{
@@ -230,3 +246,34 @@ func TestProvisionCandidatesListError(t *testing.T) {
 	assert.ErrorIs(t, err, sentinel)
 	cli.AssertExpectations(t)
 }
+
+func TestProvisionCandidatesOrdersByUpstreamID(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	b := summary("1", map[string]string{LabelUpstreamPort: "80", LabelUpstreamID: "b"}, map[string]string{"bridge": "10.0.0.2"})
+	a := summary("2", map[string]string{LabelUpstreamPort: "80", LabelUpstreamID: "a"}, map[string]string{"bridge": "10.0.0.1"})
+	web2 := summary("3", map[string]string{LabelUpstreamPort: "80"}, map[string]string{"bridge": "10.0.0.4"})
+	web2.Names = []string{"/web-2"}
+	web1 := summary("4", map[string]string{LabelUpstreamPort: "80"}, map[string]string{"bridge": "10.0.0.3"})
+	web1.Names = []string{"/web-1"}
+
+	want := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"}
+
+	// The daemon lists the containers in a different order each time.
+	for _, items := range [][]container.Summary{
+		{web2, b, web1, a},
+		{a, web1, web2, b},
+	} {
+		cli := &mockDockerClient{}
+		cli.On("ContainerList", mock.Anything, mock.Anything).
+			Return(client.ContainerListResult{Items: items}, nil)
+
+		var u Upstreams
+		require.NoError(t, u.provisionCandidates(ctx, cli))
+
+		got, err := u.GetUpstreams(prepareRequest(mustRequest(http.MethodGet, "http://example.com/")))
+		require.NoError(t, err)
+		assert.Equal(t, want, upstreamDials(got))
+	}
+}
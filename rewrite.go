@@ -0,0 +1,169 @@
+package caddy_docker_upstreams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/rewrite"
+)
+
+const (
+	LabelRewriteStripPrefix = "com.caddyserver.http.rewrite.strip_prefix"
+
+	// LabelHeadersRequestSet is followed by the name of the header to set,
+	// e.g. com.caddyserver.http.headers.request.set.X-Forwarded-Prefix.
+	LabelHeadersRequestSet = "com.caddyserver.http.headers.request.set."
+)
+
+func init() {
+	caddy.RegisterModule(Transport{})
+}
+
+// requestRewrite is how a container wants the requests proxied to it
+// rewritten, from its rewrite and headers labels.
+type requestRewrite struct {
+	stripPrefix string
+	setHeaders  map[string]string // values may hold placeholders
+}
+
+func parseRequestRewrite(labels map[string]string) requestRewrite {
+	rw := requestRewrite{stripPrefix: labels[LabelRewriteStripPrefix]}
+	for key, value := range labels {
+		name, ok := strings.CutPrefix(key, LabelHeadersRequestSet)
+		if !ok || name == "" {
+			continue
+		}
+		if rw.setHeaders == nil {
+			rw.setHeaders = make(map[string]string)
+		}
+		rw.setHeaders[name] = value
+	}
+	return rw
+}
+
+func (rw requestRewrite) empty() bool {
+	return rw.stripPrefix == "" && len(rw.setHeaders) == 0
+}
+
+// apply rewrites the request in place. The label values expand the request
+// placeholders only, as whoever labels a container must not be able to send
+// Caddy's environment or files to it through {env.*} or {file.*}.
+func (rw requestRewrite) apply(r *http.Request, repl *caddy.Replacer) {
+	repl = requestPlaceholders(repl)
+	if rw.stripPrefix != "" {
+		rewrite.Rewrite{StripPathPrefix: rw.stripPrefix}.Rewrite(r, repl)
+	}
+	for name, value := range rw.setHeaders {
+		r.Header.Set(name, repl.ReplaceKnown(value, ""))
+	}
+}
+
+// requestPlaceholders returns a replacer resolving only the http.*
+// placeholders of repl.
+func requestPlaceholders(repl *caddy.Replacer) *caddy.Replacer {
+	out := caddy.NewEmptyReplacer()
+	out.Map(func(key string) (any, bool) {
+		if !strings.HasPrefix(key, "http.") {
+			return nil, false
+		}
+		return repl.Get(key)
+	})
+	return out
+}
+
+// Transport applies the rewrite and headers labels of the container the
+// reverse proxy selected to the request, then hands it to the wrapped
+// transport. It is a transport rather than a handler because the container
+// is only known once the reverse proxy has selected an upstream, which is
+// after the handlers before it have run.
+type Transport struct {
+	// TransportRaw is the transport that proxies the rewritten request.
+	// Defaults to the http transport.
+	TransportRaw json.RawMessage `json:"transport,omitempty" caddy:"namespace=http.reverse_proxy.transport inline_key=protocol"`
+
+	transport http.RoundTripper
+}
+
+func (Transport) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.transport.docker",
+		New: func() caddy.Module { return new(Transport) },
+	}
+}
+
+func (t *Transport) Provision(ctx caddy.Context) error {
+	if t.TransportRaw == nil {
+		t.TransportRaw = caddyconfig.JSONModuleObject(new(reverseproxy.HTTPTransport), "protocol", "http", nil)
+	}
+
+	mod, err := ctx.LoadModule(t, "TransportRaw")
+	if err != nil {
+		return fmt.Errorf("loading transport: %w", err)
+	}
+	transport, ok := mod.(http.RoundTripper)
+	if !ok {
+		return fmt.Errorf("transport %T is not a round tripper", mod)
+	}
+	t.transport = transport
+	return nil
+}
+
+// RoundTrip rewrites a copy of the request, as the reverse proxy reuses the
+// request when it retries another upstream.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c, ok := selectedCandidate(r.Context())
+	if ok && !c.rewrite.empty() {
+		repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if !ok {
+			repl = caddy.NewReplacer()
+		}
+		r = r.Clone(r.Context())
+		c.rewrite.apply(r, repl)
+	}
+	return t.transport.RoundTrip(r)
+}
+
+// TLSEnabled reports whether the wrapped transport uses TLS.
+func (t *Transport) TLSEnabled() bool {
+	tt, ok := t.transport.(reverseproxy.TLSTransport)
+	return ok && tt.TLSEnabled()
+}
+
+// EnableTLS enables TLS on the wrapped transport.
+func (t *Transport) EnableTLS(base *reverseproxy.TLSConfig) error {
+	tt, ok := t.transport.(reverseproxy.TLSTransport)
+	if !ok {
+		return fmt.Errorf("transport %T does not support TLS", t.transport)
+	}
+	return tt.EnableTLS(base)
+}
+
+// UnmarshalCaddyfile sets up the transport from Caddyfile tokens. It takes
+// the options of the http transport, which it wraps.
+//
+//	transport docker {
+//	    <http transport options>
+//	}
+func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	var ht reverseproxy.HTTPTransport
+	err := ht.UnmarshalCaddyfile(d)
+	if err != nil {
+		return err
+	}
+	t.TransportRaw = caddyconfig.JSONModuleObject(ht, "protocol", "http", nil)
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner         = (*Transport)(nil)
+	_ http.RoundTripper         = (*Transport)(nil)
+	_ reverseproxy.TLSTransport = (*Transport)(nil)
+	_ caddyfile.Unmarshaler     = (*Transport)(nil)
+)
@@ -0,0 +1,130 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestProvisionCandidatesRecordsRewrite(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{
+			summary("a", map[string]string{
+				LabelUpstreamPort:                             "80",
+				LabelRewriteStripPrefix:                       "/api",
+				LabelHeadersRequestSet + "X-Forwarded-Prefix": "/api",
+				LabelHeadersRequestSet:                        "ignored",
+			}, map[string]string{"bridge": "10.0.0.1"}),
+			summary("b", map[string]string{LabelUpstreamPort: "80"}, map[string]string{"bridge": "10.0.0.2"}),
+		}}, nil)
+
+	var u Upstreams
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+	require.Len(t, candidates, 2)
+	assert.Equal(t, requestRewrite{
+		stripPrefix: "/api",
+		setHeaders:  map[string]string{"X-Forwarded-Prefix": "/api"},
+	}, candidates[0].rewrite)
+	assert.True(t, candidates[1].rewrite.empty())
+}
+
+func TestTransportRewritesForSelectedContainer(t *testing.T) {
+	withCandidates(t)
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{address: "10.0.0.1", port: "80", scheme: schemeHTTP, rewrite: requestRewrite{
+			stripPrefix: "/api",
+			setHeaders:  map[string]string{"X-Forwarded-Prefix": "/api", "X-Upstream-Scheme": "{http.docker.scheme}"},
+		}},
+		{address: "10.0.0.2", port: "80"},
+	}
+	candidatesMu.Unlock()
+
+	var got *http.Request
+	tr := &Transport{transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		got = r
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})}
+
+	req := newRequest(t, http.MethodGet, "http://example.com/api/users?page=2")
+	var u Upstreams
+	ups, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+	require.Len(t, ups, 2)
+
+	selectUpstream(req, ups[0])
+	_, err = tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "/users", got.URL.Path)
+	assert.Equal(t, "page=2", got.URL.RawQuery)
+	assert.Equal(t, "/api", got.Header.Get("X-Forwarded-Prefix"))
+	assert.Equal(t, schemeHTTP, got.Header.Get("X-Upstream-Scheme"))
+
+	// The request is reused on retries, so it is left untouched.
+	assert.Equal(t, "/api/users", req.URL.Path)
+	assert.Empty(t, req.Header.Get("X-Forwarded-Prefix"))
+
+	// Another container gets the request as is.
+	selectUpstream(req, ups[1])
+	_, err = tr.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Same(t, req, got)
+}
+
+func TestUnmarshalCaddyfileTransport(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		read_buffer 8KiB
+	}`)
+	var tr Transport
+	require.NoError(t, tr.UnmarshalCaddyfile(d))
+	assert.JSONEq(t, `{"protocol": "http", "read_buffer_size": 8192}`, string(tr.TransportRaw))
+
+	d = caddyfile.NewTestDispenser(`docker {
+		bogus
+	}`)
+	assert.Error(t, (&Transport{}).UnmarshalCaddyfile(d))
+}
+
+func TestRequestRewriteExpandsRequestPlaceholdersOnly(t *testing.T) {
+	t.Setenv("DOCKER_UPSTREAMS_SECRET", "secret")
+	file := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(file, []byte("secret"), 0o600))
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("http.request.id", "abc")
+	// The request replacer itself resolves both.
+	require.Equal(t, "secret", repl.ReplaceAll("{env.DOCKER_UPSTREAMS_SECRET}", ""))
+	require.Equal(t, "secret", repl.ReplaceAll("{file."+file+"}", ""))
+
+	rw := requestRewrite{setHeaders: map[string]string{
+		"X-Request-Id": "{http.request.id}",
+		"X-Env":        "{env.DOCKER_UPSTREAMS_SECRET}",
+		"X-File":       "{file." + file + "}",
+	}}
+	rw.apply(req, repl)
+
+	assert.Equal(t, "abc", req.Header.Get("X-Request-Id"))
+	assert.Equal(t, "{env.DOCKER_UPSTREAMS_SECRET}", req.Header.Get("X-Env"))
+	assert.Equal(t, "{file."+file+"}", req.Header.Get("X-File"))
+}
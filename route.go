@@ -0,0 +1,62 @@
+package caddy_docker_upstreams
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// RouteByLabel routes each request to the containers whose label equals the
+// value of a request header, e.g. X-Api-Version to a version label, so a new
+// version is deployed by labeling its containers alone.
+type RouteByLabel struct {
+	// Label is the container label compared with the header.
+	Label string `json:"label,omitempty"`
+
+	// Header is the request header holding the label value to route to.
+	Header string `json:"header,omitempty"`
+
+	// Fallback is the label value routed to when the request lacks the
+	// header, or no container carries its value. Without it, such requests
+	// have no upstream.
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// values returns the label values to route the request to, in order of
+// preference. Without routing it returns a single empty value, which
+// serves accepts for every candidate.
+func (rb *RouteByLabel) values(r *http.Request) []string {
+	if rb == nil {
+		return []string{""}
+	}
+
+	var values []string
+	if value := r.Header.Get(rb.Header); value != "" {
+		values = append(values, value)
+	}
+	if rb.Fallback != "" && (len(values) == 0 || values[0] != rb.Fallback) {
+		values = append(values, rb.Fallback)
+	}
+	return values
+}
+
+// serves reports whether the candidate serves requests routed to value.
+func (rb *RouteByLabel) serves(c candidate, value string) bool {
+	if rb == nil {
+		return true
+	}
+	got, ok := c.labels[rb.Label]
+	return ok && got == value
+}
+
+func (rb *RouteByLabel) validate() error {
+	if rb == nil {
+		return nil
+	}
+	if rb.Label == "" {
+		return fmt.Errorf("route_by_label requires a label")
+	}
+	if rb.Header == "" {
+		return fmt.Errorf("route_by_label requires a header")
+	}
+	return nil
+}
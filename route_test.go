@@ -0,0 +1,95 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUpstreamsRouteByLabel(t *testing.T) {
+	withCandidates(t)
+
+	const label = "com.example.api.version"
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{labels: map[string]string{label: "v1"}, address: "10.0.0.1", port: "80"},
+		{labels: map[string]string{label: "v2"}, address: "10.0.0.2", port: "80"},
+		{labels: map[string]string{label: "v2"}, address: "10.0.0.3", port: "80"},
+		{labels: nil, address: "10.0.0.4", port: "80"},
+	}
+	candidatesMu.Unlock()
+
+	tests := []struct {
+		name     string
+		fallback string
+		header   string
+		want     []string
+	}{
+		{name: "routes to the header value", header: "v2", want: []string{"10.0.0.2:80", "10.0.0.3:80"}},
+		{name: "missing header uses the fallback", fallback: "v1", want: []string{"10.0.0.1:80"}},
+		{name: "unknown value uses the fallback", fallback: "v1", header: "v9", want: []string{"10.0.0.1:80"}},
+		{name: "header wins over the fallback", fallback: "v1", header: "v2", want: []string{"10.0.0.2:80", "10.0.0.3:80"}},
+		{name: "missing header without fallback", want: []string{}},
+		{name: "unknown value without fallback", header: "v9", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := Upstreams{RouteByLabel: &RouteByLabel{Label: label, Header: "X-Api-Version", Fallback: tt.fallback}}
+
+			r := mustRequest(http.MethodGet, "http://example.com/")
+			if tt.header != "" {
+				r.Header.Set("X-Api-Version", tt.header)
+			}
+
+			got, err := u.GetUpstreams(prepareRequest(r))
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tt.want, upstreamDials(got))
+		})
+	}
+}
+
+func TestValidateRouteByLabel(t *testing.T) {
+	assert.NoError(t, (&Upstreams{RouteByLabel: &RouteByLabel{Label: "version", Header: "X-Api-Version"}}).Validate())
+	assert.Error(t, (&Upstreams{RouteByLabel: &RouteByLabel{Header: "X-Api-Version"}}).Validate())
+	assert.Error(t, (&Upstreams{RouteByLabel: &RouteByLabel{Label: "version"}}).Validate())
+}
+
+func TestUnmarshalCaddyfileRouteByLabel(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		route_by_label com.example.api.version header X-Api-Version fallback v1
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, &RouteByLabel{Label: "com.example.api.version", Header: "X-Api-Version", Fallback: "v1"}, u.RouteByLabel)
+
+	d = caddyfile.NewTestDispenser(`docker {
+		route_by_label com.example.api.version header X-Api-Version
+	}`)
+	u = Upstreams{}
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, &RouteByLabel{Label: "com.example.api.version", Header: "X-Api-Version"}, u.RouteByLabel)
+
+	for _, input := range []string{
+		`docker {
+			route_by_label
+		}`,
+		`docker {
+			route_by_label version header
+		}`,
+		`docker {
+			route_by_label version query version
+		}`,
+		`docker {
+			route_by_label version header X-Api-Version v1
+		}`,
+		`docker {
+			route_by_label version header X-Api-Version default v1
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
@@ -0,0 +1,238 @@
+package caddy_docker_upstreams
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Labels Docker Compose sets on the containers it creates.
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeNumberLabel  = "com.docker.compose.container-number"
+)
+
+// Operators of a label requirement.
+const (
+	selectorExists    = "exists"
+	selectorNotExists = "!exists"
+	selectorIn        = "in"
+	selectorNotIn     = "notin"
+	selectorMatch     = "match"
+)
+
+// requirement is one compiled label selector, evaluated against the labels
+// of a container.
+type requirement struct {
+	key      string
+	op       string
+	values   []string
+	patterns []*regexp.Regexp // for selectorMatch
+}
+
+// matches reports whether labels satisfy the requirement. As in Kubernetes,
+// notin is satisfied by a container without the label.
+func (r requirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.op {
+	case selectorExists:
+		return ok
+	case selectorNotExists:
+		return !ok
+	case selectorIn:
+		return ok && slices.Contains(r.values, value)
+	case selectorNotIn:
+		return !ok || !slices.Contains(r.values, value)
+	case selectorMatch:
+		return ok && slices.ContainsFunc(r.patterns, func(re *regexp.Regexp) bool {
+			return re.MatchString(value)
+		})
+	}
+	return false
+}
+
+// matchesAll reports whether labels satisfy every requirement.
+func matchesAll(reqs []requirement, labels map[string]string) bool {
+	for _, req := range reqs {
+		if !req.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// compileSelectors compiles LabelExists, LabelNot, LabelMatch, the Compose
+// shorthands and LabelSelector into the requirements checked by selects.
+func (u *Upstreams) compileSelectors() error {
+	var reqs []requirement
+
+	for _, key := range u.LabelExists {
+		reqs = append(reqs, requirement{key: key, op: selectorExists})
+	}
+
+	for key, values := range u.LabelNot {
+		if len(values) == 0 {
+			reqs = append(reqs, requirement{key: key, op: selectorNotExists})
+			continue
+		}
+		reqs = append(reqs, requirement{key: key, op: selectorNotIn, values: values})
+	}
+
+	for key, exprs := range u.LabelMatch {
+		req, err := matchRequirement(key, exprs)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, req)
+	}
+
+	if u.ComposeProject != "" {
+		reqs = append(reqs, requirement{key: composeProjectLabel, op: selectorIn, values: []string{u.ComposeProject}})
+	}
+	if len(u.ComposeService) > 0 {
+		reqs = append(reqs, requirement{key: composeServiceLabel, op: selectorIn, values: u.ComposeService})
+	}
+
+	if u.LabelSelector != "" {
+		parsed, err := parseLabelSelector(u.LabelSelector)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, parsed...)
+	}
+
+	u.requirements = reqs
+	return u.Split.compile()
+}
+
+func matchRequirement(key string, exprs []string) (requirement, error) {
+	req := requirement{key: key, op: selectorMatch}
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return requirement{}, fmt.Errorf("invalid pattern for label '%s': %w", key, err)
+		}
+		req.patterns = append(req.patterns, re)
+	}
+	return req, nil
+}
+
+var (
+	setRequirement   = regexp.MustCompile(`^([^\s!=(),]+)\s+(in|notin)\s*\(([^()]*)\)$`)
+	equalRequirement = regexp.MustCompile(`^([^\s!=(),]+)\s*(==|=|!=)\s*([^\s!=(),]*)$`)
+	existRequirement = regexp.MustCompile(`^(!?)\s*([^\s!=(),]+)$`)
+)
+
+// parseLabelSelector parses a Kubernetes-style label selector: a comma
+// separated list of requirements, all of which must hold.
+//
+//	key                   the label is set
+//	!key                  the label is not set
+//	key=value, key==value the label equals value
+//	key!=value            the label is not set or differs from value
+//	key in (v1,v2)        the label equals one of the values
+//	key notin (v1,v2)     the label is not set or equals none of the values
+func parseLabelSelector(selector string) ([]requirement, error) {
+	var reqs []requirement
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("invalid label selector '%s': empty requirement", selector)
+		}
+
+		if m := setRequirement.FindStringSubmatch(part); m != nil {
+			var values []string
+			for _, value := range strings.Split(m[3], ",") {
+				values = append(values, strings.TrimSpace(value))
+			}
+			op := selectorIn
+			if m[2] == "notin" {
+				op = selectorNotIn
+			}
+			reqs = append(reqs, requirement{key: m[1], op: op, values: values})
+			continue
+		}
+
+		if m := equalRequirement.FindStringSubmatch(part); m != nil {
+			op := selectorIn
+			if m[2] == "!=" {
+				op = selectorNotIn
+			}
+			reqs = append(reqs, requirement{key: m[1], op: op, values: []string{m[3]}})
+			continue
+		}
+
+		if m := existRequirement.FindStringSubmatch(part); m != nil {
+			op := selectorExists
+			if m[1] == "!" {
+				op = selectorNotExists
+			}
+			reqs = append(reqs, requirement{key: m[2], op: op})
+			continue
+		}
+
+		return nil, fmt.Errorf("invalid label selector '%s': unable to parse '%s'", selector, part)
+	}
+	return reqs, nil
+}
+
+// splitSelector splits a selector on the commas outside parentheses.
+func splitSelector(selector string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range selector {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+// containerNames strips the leading slash Docker reports names with.
+func containerNames(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		out = append(out, strings.TrimPrefix(name, "/"))
+	}
+	return out
+}
+
+// validGlob reports why pattern is not a valid glob.
+func validGlob(pattern string) error {
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+	}
+	return nil
+}
+
+// matchGlobs reports whether name matches one of the glob patterns.
+func matchGlobs(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchImage reports whether the image reference matches one of the glob
+// patterns, either as a whole or without its tag and digest.
+func matchImage(patterns []string, image string) bool {
+	repository, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return matchGlobs(patterns, image) || matchGlobs(patterns, repository)
+}
@@ -0,0 +1,247 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	labels := map[string]string{
+		"tier":  "web",
+		"track": "stable",
+		"app":   "shop",
+	}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"app", true},
+		{"!legacy", true},
+		{"!app", false},
+		{"tier=web", true},
+		{"tier==web", true},
+		{"tier = api", false},
+		{"tier!=api", true},
+		{"legacy!=true", true},
+		{"tier in (web,api)", true},
+		{"tier in (api, worker)", false},
+		{"track notin (canary)", true},
+		{"legacy notin (true)", true},
+		{"tier in (web,api), track notin (canary), !legacy", true},
+		{"tier in (web,api), track notin (stable)", false},
+	}
+	for _, tt := range tests {
+		reqs, err := parseLabelSelector(tt.selector)
+		require.NoError(t, err, tt.selector)
+
+		got := true
+		for _, req := range reqs {
+			got = got && req.matches(labels)
+		}
+		assert.Equal(t, tt.want, got, tt.selector)
+	}
+
+	for _, selector := range []string{
+		"",
+		"tier in web",
+		"tier in (web",
+		"tier=web,",
+		"tier=web=api",
+		"a b",
+	} {
+		_, err := parseLabelSelector(selector)
+		assert.Error(t, err, selector)
+	}
+}
+
+func TestGetUpstreamsLabelRequirements(t *testing.T) {
+	withCandidates(t)
+
+	const service = "com.docker.compose.service"
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{labels: map[string]string{service: "api-v1", "tier": "web"}, address: "10.0.0.1", port: "80"},
+		{labels: map[string]string{service: "api-v2"}, address: "10.0.0.2", port: "80"},
+		{labels: map[string]string{service: "canary", "tier": "web"}, address: "10.0.0.3", port: "80"},
+		{labels: nil, address: "10.0.0.4", port: "80"},
+	}
+	candidatesMu.Unlock()
+
+	req := prepareRequest(mustRequest(http.MethodGet, "http://example.com/"))
+
+	tests := []struct {
+		name string
+		u    Upstreams
+		want []string
+	}{
+		{
+			name: "label exists",
+			u:    Upstreams{LabelExists: []string{"tier"}},
+			want: []string{"10.0.0.1:80", "10.0.0.3:80"},
+		},
+		{
+			name: "label not value",
+			u:    Upstreams{LabelNot: map[string][]string{service: {"canary"}}},
+			want: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.4:80"},
+		},
+		{
+			name: "label not set",
+			u:    Upstreams{LabelNot: map[string][]string{"tier": nil}},
+			want: []string{"10.0.0.2:80", "10.0.0.4:80"},
+		},
+		{
+			name: "label match",
+			u:    Upstreams{LabelMatch: map[string][]string{service: {`^api-v[0-9]+$`}}},
+			want: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		},
+		{
+			name: "label selector",
+			u:    Upstreams{LabelSelector: "tier=web, com.docker.compose.service notin (canary)"},
+			want: []string{"10.0.0.1:80"},
+		},
+		{
+			name: "combined with labels",
+			u: Upstreams{
+				Labels:     map[string][]string{"tier": {"web"}},
+				LabelMatch: map[string][]string{service: {`^api-`}},
+			},
+			want: []string{"10.0.0.1:80"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.u.compileSelectors())
+			got, err := tt.u.GetUpstreams(req)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tt.want, upstreamDials(got))
+		})
+	}
+}
+
+func TestCompileSelectorsInvalidPattern(t *testing.T) {
+	u := Upstreams{LabelMatch: map[string][]string{"tier": {"(web"}}}
+	assert.Error(t, u.compileSelectors())
+
+	u = Upstreams{LabelSelector: "tier in"}
+	assert.Error(t, u.compileSelectors())
+}
+
+func TestMatchImage(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		image    string
+		want     bool
+	}{
+		{[]string{"nginx"}, "nginx:latest", true},
+		{[]string{"nginx:1.27"}, "nginx:latest", false},
+		{[]string{"nginx:*"}, "nginx:1.27", true},
+		{[]string{"ghcr.io/example/*"}, "ghcr.io/example/api:v2", true},
+		{[]string{"ghcr.io/example/*"}, "ghcr.io/other/api:v2", false},
+		{[]string{"localhost:5000/app"}, "localhost:5000/app:1", true},
+		{[]string{"app"}, "app@sha256:0123", true},
+		{[]string{"redis", "nginx"}, "nginx", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchImage(tt.patterns, tt.image), "%v %s", tt.patterns, tt.image)
+	}
+}
+
+func TestGetUpstreamsNameImageAndCompose(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	web := summary("a", map[string]string{
+		LabelUpstreamPort:   "80",
+		composeProjectLabel: "shop",
+		composeServiceLabel: "web",
+	}, map[string]string{"bridge": "10.0.0.1"})
+	web.Names = []string{"/shop-web-1"}
+	web.Image = "nginx:1.27"
+
+	api := summary("b", map[string]string{
+		LabelUpstreamPort:   "80",
+		composeProjectLabel: "shop",
+		composeServiceLabel: "api",
+	}, map[string]string{"bridge": "10.0.0.2"})
+	api.Names = []string{"/shop-api-1"}
+	api.Image = "ghcr.io/example/api:v2"
+
+	other := summary("c", map[string]string{
+		LabelUpstreamPort:   "80",
+		composeProjectLabel: "blog",
+		composeServiceLabel: "web",
+	}, map[string]string{"bridge": "10.0.0.3"})
+	other.Names = []string{"/blog-web-1"}
+	other.Image = "nginx:latest"
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{web, api, other}}, nil)
+	require.NoError(t, (&Upstreams{}).provisionCandidates(ctx, cli))
+
+	req := prepareRequest(mustRequest(http.MethodGet, "http://example.com/"))
+
+	tests := []struct {
+		name string
+		u    Upstreams
+		want []string
+	}{
+		{
+			name: "container name",
+			u:    Upstreams{ContainerName: []string{"shop-*"}},
+			want: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		},
+		{
+			name: "image",
+			u:    Upstreams{Image: []string{"nginx"}},
+			want: []string{"10.0.0.1:80", "10.0.0.3:80"},
+		},
+		{
+			name: "compose project",
+			u:    Upstreams{ComposeProject: "shop"},
+			want: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		},
+		{
+			name: "compose services are ORed",
+			u:    Upstreams{ComposeService: []string{"web", "api"}},
+			want: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+		},
+		{
+			name: "selectors are ANDed",
+			u: Upstreams{
+				ComposeService: []string{"web"},
+				Image:          []string{"nginx:1.*"},
+			},
+			want: []string{"10.0.0.1:80"},
+		},
+		{
+			name: "combined with labels",
+			u: Upstreams{
+				Labels:        map[string][]string{composeServiceLabel: {"web"}},
+				ContainerName: []string{"blog-*"},
+			},
+			want: []string{"10.0.0.3:80"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.u.compileSelectors())
+			got, err := tt.u.GetUpstreams(req)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tt.want, upstreamDials(got))
+		})
+	}
+}
+
+func TestValidateGlobs(t *testing.T) {
+	assert.NoError(t, (&Upstreams{ContainerName: []string{"web-*"}, Image: []string{"nginx:1.2?"}}).Validate())
+	assert.Error(t, (&Upstreams{ContainerName: []string{"web-["}}).Validate())
+	assert.Error(t, (&Upstreams{Image: []string{"nginx\\"}}).Validate())
+}
@@ -0,0 +1,71 @@
+package caddy_docker_upstreams
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/moby/moby/api/types/container"
+	"go.uber.org/zap"
+)
+
+const LabelSlowStart = "com.caddyserver.http.slow_start"
+
+// discoveryTimes returns when each container in the source's partition was
+// first discovered, by container ID.
+func discoveryTimes(source string) map[string]time.Time {
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+
+	times := make(map[string]time.Time)
+	for _, c := range candidates {
+		if c.source == source {
+			times[c.id] = c.discovered
+		}
+	}
+	return times
+}
+
+// parseSlowStart returns the container's slow start label, if it carries a
+// valid one.
+func parseSlowStart(ctx caddy.Context, c container.Summary) (time.Duration, bool) {
+	value, ok := c.Labels[LabelSlowStart]
+	if !ok {
+		return 0, false
+	}
+
+	window, err := caddy.ParseDuration(value)
+	if err != nil {
+		ctx.Logger().Error("unable to parse slow start",
+			zap.String("container_id", c.ID),
+			zap.String("value", value),
+			zap.Error(err),
+		)
+		return 0, false
+	}
+	return window, true
+}
+
+// warming reports whether the candidate is still in its slow-start window, and
+// if so, the share of its traffic it should receive: ramping linearly from 0
+// at discovery to 1 at the end of the window.
+func (u *Upstreams) warming(c candidate, now time.Time) (float64, bool) {
+	window := time.Duration(u.SlowStart)
+	if c.hasSlowStart {
+		window = c.slowStart
+	}
+	if window <= 0 || c.discovered.IsZero() {
+		return 1, false
+	}
+
+	elapsed := now.Sub(c.discovered)
+	if elapsed >= window {
+		return 1, false
+	}
+	return float64(elapsed) / float64(window), true
+}
+
+// admits draws whether a warming candidate takes part in this request.
+func admits(share float64) bool {
+	return rand.Float64() < share
+}
@@ -0,0 +1,155 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionCandidatesTracksDiscovery(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	existing := summary("existing",
+		map[string]string{LabelUpstreamPort: "8080"},
+		map[string]string{"bridge": "10.0.0.1"},
+	)
+	added := summary("added",
+		map[string]string{LabelUpstreamPort: "8080", LabelSlowStart: "1m"},
+		map[string]string{"bridge": "10.0.0.2"},
+	)
+	invalid := summary("invalid",
+		map[string]string{LabelUpstreamPort: "8080", LabelSlowStart: "soon"},
+		map[string]string{"bridge": "10.0.0.3"},
+	)
+
+	list := func(cs ...container.Summary) *mockDockerClient {
+		cli := &mockDockerClient{}
+		cli.On("ContainerList", mock.Anything, mock.Anything).
+			Return(client.ContainerListResult{Items: cs}, nil)
+		return cli
+	}
+	byID := func() map[string]candidate {
+		candidatesMu.RLock()
+		defer candidatesMu.RUnlock()
+		out := make(map[string]candidate)
+		for _, c := range candidates {
+			out[c.id] = c
+		}
+		return out
+	}
+
+	var u Upstreams
+
+	// Containers found by the first listing are already serving.
+	require.NoError(t, u.provisionCandidates(ctx, list(existing)))
+	assert.True(t, byID()["existing"].discovered.IsZero())
+
+	before := time.Now()
+	require.NoError(t, u.provisionCandidates(ctx, list(existing, added, invalid)))
+	got := byID()
+	assert.True(t, got["existing"].discovered.IsZero())
+	assert.False(t, got["added"].discovered.Before(before))
+	assert.True(t, got["added"].hasSlowStart)
+	assert.Equal(t, time.Minute, got["added"].slowStart)
+	assert.False(t, got["invalid"].hasSlowStart, "an invalid label is ignored")
+
+	// Later refreshes keep the first discovery time.
+	first := got["added"].discovered
+	require.NoError(t, u.provisionCandidates(ctx, list(existing, added)))
+	assert.Equal(t, first, byID()["added"].discovered)
+}
+
+func TestWarming(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		slowStart time.Duration
+		candidate candidate
+		wantShare float64
+		wantOK    bool
+	}{
+		{
+			name:      "disabled",
+			candidate: candidate{discovered: now.Add(-time.Second)},
+			wantShare: 1,
+		},
+		{
+			name:      "halfway through the window",
+			slowStart: time.Minute,
+			candidate: candidate{discovered: now.Add(-30 * time.Second)},
+			wantShare: 0.5,
+			wantOK:    true,
+		},
+		{
+			name:      "past the window",
+			slowStart: time.Minute,
+			candidate: candidate{discovered: now.Add(-2 * time.Minute)},
+			wantShare: 1,
+		},
+		{
+			name:      "serving since the first listing",
+			slowStart: time.Minute,
+			candidate: candidate{},
+			wantShare: 1,
+		},
+		{
+			name:      "label overrides the block",
+			slowStart: time.Minute,
+			candidate: candidate{discovered: now.Add(-30 * time.Second), slowStart: 2 * time.Minute, hasSlowStart: true},
+			wantShare: 0.25,
+			wantOK:    true,
+		},
+		{
+			name:      "label disables the block's window",
+			slowStart: time.Minute,
+			candidate: candidate{discovered: now.Add(-30 * time.Second), hasSlowStart: true},
+			wantShare: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := Upstreams{SlowStart: caddy.Duration(tt.slowStart)}
+			share, ok := u.warming(tt.candidate, now)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.InDelta(t, tt.wantShare, share, 1e-9)
+		})
+	}
+}
+
+func TestGetUpstreamsSlowStart(t *testing.T) {
+	withCandidates(t)
+
+	serving := candidate{id: "serving", address: "10.0.0.1", port: "8080"}
+	// Just discovered with an hour to warm up: practically never admitted.
+	warming := candidate{id: "warming", address: "10.0.0.2", port: "8080", discovered: time.Now()}
+
+	u := Upstreams{SlowStart: caddy.Duration(time.Hour)}
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+
+	candidatesMu.Lock()
+	candidates = []candidate{serving, warming}
+	candidatesMu.Unlock()
+
+	got, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, upstreamDials(got))
+
+	// With nothing else to serve the request, a warming candidate still does.
+	candidatesMu.Lock()
+	candidates = []candidate{warming}
+	candidatesMu.Unlock()
+
+	got, err = u.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2:8080"}, upstreamDials(got))
+}
@@ -0,0 +1,172 @@
+package caddy_docker_upstreams
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	splitByRandom = "random"
+	splitByHeader = "header"
+	splitByCookie = "cookie"
+)
+
+// Split divides the traffic of a block between groups of containers, e.g.
+// 95% to version=stable and 5% to version=canary. Each request is served by
+// the containers of one group only.
+type Split struct {
+	// By chooses how a request is assigned a group: random (default) draws
+	// one per request; header and cookie hash the value of the header or
+	// cookie called Name, so a client keeps landing in the same group.
+	// Requests without the value are drawn at random.
+	By   string `json:"by,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	// Groups are the container groups, in order. A container belongs to
+	// the first group whose selector it satisfies; containers outside every
+	// group are not served.
+	Groups []SplitGroup `json:"groups,omitempty"`
+}
+
+// SplitGroup is a group of containers and the share of traffic it receives.
+type SplitGroup struct {
+	// Selector is a Kubernetes-style label selector, e.g. version=canary.
+	Selector string `json:"selector,omitempty"`
+
+	// Weight is the group's share of the traffic, relative to the weights of
+	// the other groups; percentages adding up to 100 read best.
+	Weight int `json:"weight,omitempty"`
+
+	requirements []requirement
+}
+
+// compile parses the selectors of the groups.
+func (s *Split) compile() error {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Groups {
+		reqs, err := parseLabelSelector(s.Groups[i].Selector)
+		if err != nil {
+			return fmt.Errorf("split: %w", err)
+		}
+		s.Groups[i].requirements = reqs
+	}
+	return nil
+}
+
+func (s *Split) validate() error {
+	if s == nil {
+		return nil
+	}
+
+	switch s.By {
+	case "", splitByRandom:
+		if s.Name != "" {
+			return fmt.Errorf("split by %s does not take a name", splitByRandom)
+		}
+	case splitByHeader, splitByCookie:
+		if s.Name == "" {
+			return fmt.Errorf("split by %s requires a name", s.By)
+		}
+	default:
+		return fmt.Errorf("unrecognized split by '%s'", s.By)
+	}
+
+	if len(s.Groups) == 0 {
+		return fmt.Errorf("split requires at least one group")
+	}
+	for _, g := range s.Groups {
+		if g.Weight < 0 {
+			return fmt.Errorf("split weight of '%s' must not be negative", g.Selector)
+		}
+	}
+	if s.total() == 0 {
+		return fmt.Errorf("split weights must not all be zero")
+	}
+	return nil
+}
+
+func (s *Split) total() int {
+	total := 0
+	for _, g := range s.Groups {
+		total += g.Weight
+	}
+	return total
+}
+
+// choose returns the index of the group serving the request, or -1 when
+// the block does not split its traffic.
+func (s *Split) choose(r *http.Request) int {
+	if s == nil {
+		return -1
+	}
+
+	var key string
+	switch s.By {
+	case splitByHeader:
+		key = r.Header.Get(s.Name)
+	case splitByCookie:
+		if cookie, err := r.Cookie(s.Name); err == nil {
+			key = cookie.Value
+		}
+	}
+
+	var n int
+	if key == "" {
+		n = rand.IntN(s.total())
+	} else {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(s.total()))
+	}
+
+	for i, g := range s.Groups {
+		if n < g.Weight {
+			return i
+		}
+		n -= g.Weight
+	}
+	return len(s.Groups) - 1
+}
+
+// group returns the index of the group the candidate belongs to, or -1 when
+// it belongs to none.
+func (s *Split) group(c candidate) int {
+	for i, g := range s.Groups {
+		if matchesAll(g.requirements, c.labels) {
+			return i
+		}
+	}
+	return -1
+}
+
+// serves returns whether the candidate may serve a request assigned to the
+// given group; any group when group is -1.
+func (s *Split) serves(c candidate, group int) bool {
+	if s == nil {
+		return true
+	}
+	in := s.group(c)
+	return in >= 0 && (group < 0 || in == group)
+}
+
+// parseSplitGroup parses a group line of the split block: a weight, as a
+// percentage or a plain number, followed by a label selector.
+func parseSplitGroup(args []string) (SplitGroup, error) {
+	weight, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+	if err != nil || weight < 0 {
+		return SplitGroup{}, fmt.Errorf("invalid split weight '%s'", args[0])
+	}
+
+	g := SplitGroup{Selector: strings.Join(args[1:], " "), Weight: weight}
+	_, err = parseLabelSelector(g.Selector)
+	if err != nil {
+		return SplitGroup{}, err
+	}
+	return g, nil
+}
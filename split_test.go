@@ -0,0 +1,179 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func canarySplit(t *testing.T, by, name string, stable, canary int) *Split {
+	t.Helper()
+	s := &Split{By: by, Name: name, Groups: []SplitGroup{
+		{Selector: "version=stable", Weight: stable},
+		{Selector: "version=canary", Weight: canary},
+	}}
+	require.NoError(t, s.compile())
+	return s
+}
+
+func TestSplitChoose(t *testing.T) {
+	var none *Split
+	assert.Equal(t, -1, none.choose(mustRequest(http.MethodGet, "http://example.com/")))
+
+	t.Run("random follows the weights", func(t *testing.T) {
+		s := canarySplit(t, "", "", 90, 10)
+		counts := make([]int, 2)
+		for range 10000 {
+			counts[s.choose(mustRequest(http.MethodGet, "http://example.com/"))]++
+		}
+		assert.InDelta(t, 1000, counts[1], 250)
+	})
+
+	t.Run("zero weight is never chosen", func(t *testing.T) {
+		s := canarySplit(t, "", "", 100, 0)
+		for range 1000 {
+			assert.Equal(t, 0, s.choose(mustRequest(http.MethodGet, "http://example.com/")))
+		}
+	})
+
+	t.Run("header keeps a client in its group", func(t *testing.T) {
+		s := canarySplit(t, splitByHeader, "X-User", 50, 50)
+		counts := make([]int, 2)
+		for i := range 1000 {
+			r := mustRequest(http.MethodGet, "http://example.com/")
+			r.Header.Set("X-User", strconv.Itoa(i))
+			group := s.choose(r)
+			counts[group]++
+			for range 3 {
+				assert.Equal(t, group, s.choose(r))
+			}
+		}
+		assert.InDelta(t, 500, counts[1], 100)
+	})
+
+	t.Run("cookie keeps a client in its group", func(t *testing.T) {
+		s := canarySplit(t, splitByCookie, "session", 50, 50)
+		r := mustRequest(http.MethodGet, "http://example.com/")
+		r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		group := s.choose(r)
+		for range 10 {
+			assert.Equal(t, group, s.choose(r))
+		}
+	})
+}
+
+func TestGetUpstreamsSplit(t *testing.T) {
+	withCandidates(t)
+
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{labels: map[string]string{"version": "stable"}, address: "10.0.0.1", port: "80"},
+		{labels: map[string]string{"version": "stable"}, address: "10.0.0.2", port: "80"},
+		{labels: map[string]string{"version": "canary"}, address: "10.0.0.3", port: "80"},
+		{labels: map[string]string{"version": "legacy"}, address: "10.0.0.4", port: "80"},
+	}
+	candidatesMu.Unlock()
+
+	stable := []string{"10.0.0.1:80", "10.0.0.2:80"}
+	canary := []string{"10.0.0.3:80"}
+
+	t.Run("serves one group per request", func(t *testing.T) {
+		u := Upstreams{Split: canarySplit(t, "", "", 50, 50)}
+		seen := make(map[int]bool)
+		for range 100 {
+			got, err := u.GetUpstreams(prepareRequest(mustRequest(http.MethodGet, "http://example.com/")))
+			require.NoError(t, err)
+			switch dials := upstreamDials(got); len(dials) {
+			case 1:
+				assert.Equal(t, canary, dials)
+				seen[1] = true
+			default:
+				assert.ElementsMatch(t, stable, dials)
+				seen[0] = true
+			}
+		}
+		assert.Len(t, seen, 2)
+	})
+
+	t.Run("falls back when the group is empty", func(t *testing.T) {
+		s := &Split{Groups: []SplitGroup{
+			{Selector: "version=stable", Weight: 0},
+			{Selector: "version=next", Weight: 100},
+		}}
+		require.NoError(t, s.compile())
+		u := Upstreams{Split: s}
+
+		got, err := u.GetUpstreams(prepareRequest(mustRequest(http.MethodGet, "http://example.com/")))
+		require.NoError(t, err)
+		assert.ElementsMatch(t, stable, upstreamDials(got))
+	})
+}
+
+func TestValidateSplit(t *testing.T) {
+	valid := &Split{By: splitByHeader, Name: "X-User", Groups: []SplitGroup{{Selector: "version=stable", Weight: 100}}}
+	assert.NoError(t, (&Upstreams{Split: valid}).Validate())
+
+	for _, s := range []*Split{
+		{Groups: []SplitGroup{{Selector: "version=stable", Weight: 100}}, By: "sometimes"},
+		{Groups: []SplitGroup{{Selector: "version=stable", Weight: 100}}, By: splitByCookie},
+		{Groups: []SplitGroup{{Selector: "version=stable", Weight: 100}}, Name: "X-User"},
+		{Groups: []SplitGroup{{Selector: "version=stable", Weight: -1}}},
+		{Groups: []SplitGroup{{Selector: "version=stable", Weight: 0}}},
+		{},
+	} {
+		assert.Error(t, (&Upstreams{Split: s}).Validate(), "%+v", s)
+	}
+}
+
+func TestUnmarshalCaddyfileSplit(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`docker {
+		split header X-User {
+			95% version=stable
+			5 version in (canary, next)
+		}
+	}`)
+	var u Upstreams
+	assert.NoError(t, u.UnmarshalCaddyfile(d))
+	assert.Equal(t, &Split{By: splitByHeader, Name: "X-User", Groups: []SplitGroup{
+		{Selector: "version=stable", Weight: 95},
+		{Selector: "version in (canary, next)", Weight: 5},
+	}}, u.Split)
+
+	for _, input := range []string{
+		`docker {
+			split
+		}`,
+		`docker {
+			split header {
+				100% version=stable
+			}
+		}`,
+		`docker {
+			split sometimes {
+				100% version=stable
+			}
+		}`,
+		`docker {
+			split {
+				100%
+			}
+		}`,
+		`docker {
+			split {
+				lots version=stable
+			}
+		}`,
+		`docker {
+			split {
+				100% version in stable
+			}
+		}`,
+	} {
+		var u Upstreams
+		assert.Error(t, u.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
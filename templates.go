@@ -0,0 +1,101 @@
+package caddy_docker_upstreams
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// expandTemplate expands the container templates in a matcher label value,
+// so replicas can declare matchers of their own, e.g.
+// {compose.service}-{compose.container_number}.internal.example.com:
+//
+//	{container.name}            the container name
+//	{compose.project}           the Compose project
+//	{compose.service}           the Compose service
+//	{compose.container_number}  the replica number within the service
+//	{label.<key>}               the value of the container's <key> label
+//
+// Other placeholders, such as {http.request.host}, are left for Caddy to
+// replace at request time, and \{ escapes a template, which Caddy then reads
+// as a literal brace. A template whose value is missing is an error.
+func expandTemplate(value string, c container.Summary) (string, error) {
+	if !strings.Contains(value, "{") {
+		return value, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && value[i+1] == '{':
+			b.WriteString(`\{`)
+			i++
+			continue
+		case value[i] != '{':
+			b.WriteByte(value[i])
+			continue
+		}
+
+		end := strings.IndexByte(value[i:], '}')
+		if end < 0 {
+			b.WriteString(value[i:])
+			break
+		}
+
+		name := value[i+1 : i+end]
+		expanded, ok, err := templateValue(name, c)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			b.WriteString(expanded)
+		} else {
+			b.WriteString(value[i : i+end+1])
+		}
+		i += end
+	}
+	return b.String(), nil
+}
+
+// expandLabel returns the value of a module label of c with its templates
+// expanded, or "" when they cannot be; buildMatchers then leaves the
+// container out and reports why.
+func expandLabel(c container.Summary, key string) string {
+	value, err := expandTemplate(c.Labels[key], c)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// templateValue returns the value of the named template. It reports false
+// for names outside the template namespaces.
+func templateValue(name string, c container.Summary) (string, bool, error) {
+	var value string
+	var ok bool
+
+	switch {
+	case name == "container.name":
+		if len(c.Names) > 0 {
+			value, ok = strings.TrimPrefix(c.Names[0], "/"), true
+		}
+	case name == "compose.project":
+		value, ok = c.Labels[composeProjectLabel]
+	case name == "compose.service":
+		value, ok = c.Labels[composeServiceLabel]
+	case name == "compose.container_number":
+		value, ok = c.Labels[composeNumberLabel]
+	case strings.HasPrefix(name, "label."):
+		value, ok = c.Labels[strings.TrimPrefix(name, "label.")]
+	case strings.HasPrefix(name, "container."), strings.HasPrefix(name, "compose."):
+		return "", false, fmt.Errorf("unknown template {%s}", name)
+	default:
+		return "", false, nil
+	}
+
+	if !ok {
+		return "", false, fmt.Errorf("no value for template {%s}", name)
+	}
+	return value, true, nil
+}
@@ -0,0 +1,54 @@
+package caddy_docker_upstreams
+
+import (
+	"testing"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	c := container.Summary{
+		Names: []string{"/app-api-2"},
+		Labels: map[string]string{
+			composeProjectLabel: "app",
+			composeServiceLabel: "api",
+			composeNumberLabel:  "2",
+			"tenant":            "acme",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "no templates", value: "example.com", want: "example.com"},
+		{name: "container name", value: "{container.name}.example.com", want: "app-api-2.example.com"},
+		{name: "compose", value: "{compose.service}-{compose.container_number}.{compose.project}.internal", want: "api-2.app.internal"},
+		{name: "label", value: "/{label.tenant}/*", want: "/acme/*"},
+		{name: "caddy placeholder kept", value: "{http.request.host}", want: "{http.request.host}"},
+		{name: "escaped", value: `\{container.name}.example.com`, want: `\{container.name}.example.com`},
+		{name: "unterminated", value: "{container.name", want: "{container.name"},
+		{name: "missing label", value: "{label.missing}", wantErr: true},
+		{name: "unknown template", value: "{container.id}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandTemplate(tt.value, c)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExpandTemplateWithoutName(t *testing.T) {
+	_, err := expandTemplate("{container.name}", container.Summary{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,126 @@
+package caddy_docker_upstreams
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+const (
+	schemeHTTP  = "http"
+	schemeH2C   = "h2c"
+	schemeHTTPS = "https"
+)
+
+// placeholderPrefix namespaces the placeholders describing the upstream the
+// reverse proxy selected.
+const placeholderPrefix = "http.docker."
+
+// selectionVarKey is the request var holding the upstreams GetUpstreams
+// returned last, and the candidates they were built from, so the candidate
+// behind the upstream the reverse proxy selects can be found; see
+// selectedCandidate.
+const selectionVarKey = "docker.selection"
+
+// selection pairs the upstreams GetUpstreams returned with their candidates,
+// or holds why it returned none.
+type selection struct {
+	upstreams   []*reverseproxy.Upstream
+	selected    []candidate
+	unavailable *UnavailableError
+}
+
+// selectedCandidate returns the candidate behind the upstream the reverse
+// proxy selected for the request, once it has.
+func selectedCandidate(ctx context.Context) (candidate, bool) {
+	sel, ok := caddyhttp.GetVar(ctx, selectionVarKey).(selection)
+	if !ok {
+		return candidate{}, false
+	}
+
+	dialInfo, ok := reverseproxy.GetDialInfo(ctx)
+	if !ok {
+		return candidate{}, false
+	}
+
+	for i, up := range sel.upstreams {
+		if up == dialInfo.Upstream {
+			return sel.selected[i], true
+		}
+	}
+	return candidate{}, false
+}
+
+// publishPlaceholders records the upstreams in the request vars, and makes
+// the container and transport hints of the upstream the reverse proxy
+// eventually selects available as placeholders:
+//
+//	{http.docker.container_id}
+//	{http.docker.container_name}
+//	{http.docker.label.<key>}
+//	{http.docker.scheme}
+//	{http.docker.tls_server_name}
+//
+// Selection happens after GetUpstreams returns, so the values are resolved
+// lazily from the dial info the reverse proxy records for the chosen
+// upstream; they are known from header_up on, and in log_append. When no
+// upstream is available, {http.docker.unavailable} holds the reason instead.
+func publishPlaceholders(r *http.Request, upstreams []*reverseproxy.Upstream, selected []candidate, unavailable *UnavailableError) {
+	if len(upstreams) == 0 && unavailable == nil {
+		return
+	}
+
+	// On a retry the selection is replaced, and the placeholders already
+	// resolve against it.
+	_, published := caddyhttp.GetVar(r.Context(), selectionVarKey).(selection)
+	caddyhttp.SetVar(r.Context(), selectionVarKey, selection{upstreams: upstreams, selected: selected, unavailable: unavailable})
+
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok || published {
+		return
+	}
+
+	repl.Map(func(key string) (any, bool) {
+		name, ok := strings.CutPrefix(key, placeholderPrefix)
+		if !ok {
+			return nil, false
+		}
+
+		if name == "unavailable" {
+			sel, _ := caddyhttp.GetVar(r.Context(), selectionVarKey).(selection)
+			if sel.unavailable == nil {
+				return "", true
+			}
+			return sel.unavailable.Reason, true
+		}
+
+		c, ok := selectedCandidate(r.Context())
+		if !ok {
+			return nil, false
+		}
+
+		if key, ok := strings.CutPrefix(name, "label."); ok {
+			value, ok := c.labels[key]
+			return value, ok
+		}
+
+		switch name {
+		case "container_id":
+			return c.id, true
+		case "container_name":
+			if len(c.names) == 0 {
+				return "", true
+			}
+			return c.names[0], true
+		case "scheme":
+			return c.scheme, true
+		case "tls_server_name":
+			return c.tlsServerName, true
+		}
+		return nil, false
+	})
+}
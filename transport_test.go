@@ -0,0 +1,183 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// selectUpstream records up as the upstream the reverse proxy chose for r,
+// the way reverse_proxy does before it dials.
+func selectUpstream(r *http.Request, up *reverseproxy.Upstream) {
+	caddyhttp.SetVar(r.Context(), "reverse_proxy.dial_info", reverseproxy.DialInfo{Upstream: up})
+}
+
+func TestProvisionCandidatesRecordsTransportHints(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, mock.Anything).
+		Return(client.ContainerListResult{Items: []container.Summary{
+			summary("plain",
+				map[string]string{LabelUpstreamPort: "80"},
+				map[string]string{"bridge": "10.0.0.1"},
+			),
+			summary("secure",
+				map[string]string{
+					LabelUpstreamPort:          "443",
+					LabelUpstreamScheme:        schemeHTTPS,
+					LabelUpstreamTLSServerName: "internal.example.com",
+				},
+				map[string]string{"bridge": "10.0.0.2"},
+			),
+		}}, nil)
+
+	var u Upstreams
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	candidatesMu.RLock()
+	defer candidatesMu.RUnlock()
+	require.Len(t, candidates, 2)
+	assert.Equal(t, schemeHTTP, candidates[0].scheme)
+	assert.Empty(t, candidates[0].tlsServerName)
+	assert.Equal(t, schemeHTTPS, candidates[1].scheme)
+	assert.Equal(t, "internal.example.com", candidates[1].tlsServerName)
+}
+
+func TestGetUpstreamsSchemeSelector(t *testing.T) {
+	withCandidates(t)
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{address: "10.0.0.1", port: "80", scheme: schemeHTTP},
+		{address: "10.0.0.2", port: "50051", scheme: schemeH2C},
+		{address: "10.0.0.3", port: "443", scheme: schemeHTTPS},
+	}
+	candidatesMu.Unlock()
+
+	tests := []struct {
+		scheme    string
+		wantDials []string
+	}{
+		{scheme: "", wantDials: []string{"10.0.0.1:80", "10.0.0.2:50051", "10.0.0.3:443"}},
+		{scheme: schemeHTTP, wantDials: []string{"10.0.0.1:80"}},
+		{scheme: schemeH2C, wantDials: []string{"10.0.0.2:50051"}},
+		{scheme: schemeHTTPS, wantDials: []string{"10.0.0.3:443"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			u := Upstreams{Scheme: tt.scheme}
+			got, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://example.com/"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantDials, upstreamDials(got))
+		})
+	}
+}
+
+func TestTransportPlaceholders(t *testing.T) {
+	withCandidates(t)
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{address: "10.0.0.1", port: "443", scheme: schemeHTTPS, tlsServerName: "one.internal"},
+		{address: "10.0.0.2", port: "443", scheme: schemeHTTPS, tlsServerName: "two.internal"},
+	}
+	candidatesMu.Unlock()
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var u Upstreams
+	got, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	// Nothing is known before the reverse proxy selects an upstream.
+	_, ok := repl.Get("http.docker.tls_server_name")
+	assert.False(t, ok)
+
+	selectUpstream(req, got[1])
+	assert.Equal(t, "two.internal", repl.ReplaceAll("{http.docker.tls_server_name}", ""))
+	assert.Equal(t, schemeHTTPS, repl.ReplaceAll("{http.docker.scheme}", ""))
+
+	selectUpstream(req, got[0])
+	assert.Equal(t, "one.internal", repl.ReplaceAll("{http.docker.tls_server_name}", ""))
+
+	// Unknown names under the prefix stay unknown.
+	_, ok = repl.Get("http.docker.bogus")
+	assert.False(t, ok)
+}
+
+func TestValidateScheme(t *testing.T) {
+	assert.NoError(t, (&Upstreams{Scheme: schemeH2C}).Validate())
+	assert.Error(t, (&Upstreams{Scheme: "ftp"}).Validate())
+}
+
+func TestContainerPlaceholders(t *testing.T) {
+	withCandidates(t)
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{id: "abc123", names: []string{"shop-web-1"}, labels: map[string]string{"com.docker.compose.service": "web"}, address: "10.0.0.1", port: "80"},
+		{id: "def456", address: "10.0.0.2", port: "80"},
+	}
+	candidatesMu.Unlock()
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var u Upstreams
+	got, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	_, ok := repl.Get("http.docker.container_id")
+	assert.False(t, ok)
+
+	selectUpstream(req, got[0])
+	assert.Equal(t, "abc123", repl.ReplaceAll("{http.docker.container_id}", ""))
+	assert.Equal(t, "shop-web-1", repl.ReplaceAll("{http.docker.container_name}", ""))
+	assert.Equal(t, "web", repl.ReplaceAll("{http.docker.label.com.docker.compose.service}", ""))
+	assert.Equal(t, "-", repl.ReplaceAll("{http.docker.label.missing}", "-"))
+
+	selectUpstream(req, got[1])
+	assert.Equal(t, "def456", repl.ReplaceAll("{http.docker.container_id}", ""))
+	assert.Equal(t, "-", repl.ReplaceAll("{http.docker.container_name}", "-"))
+	assert.Equal(t, "-", repl.ReplaceAll("{http.docker.label.com.docker.compose.service}", "-"))
+
+	// The selection is also in the request vars.
+	sel, ok := caddyhttp.GetVar(req.Context(), selectionVarKey).(selection)
+	require.True(t, ok)
+	assert.Len(t, sel.upstreams, 2)
+}
+
+func TestPlaceholdersFollowRetries(t *testing.T) {
+	withCandidates(t)
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "abc123", address: "10.0.0.1", port: "80"}}
+	candidatesMu.Unlock()
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var u Upstreams
+	_, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+
+	// A retry lists the upstreams again, with new upstream values.
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "def456", address: "10.0.0.2", port: "80"}}
+	candidatesMu.Unlock()
+	got, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+
+	selectUpstream(req, got[0])
+	assert.Equal(t, "def456", repl.ReplaceAll("{http.docker.container_id}", ""))
+}
@@ -0,0 +1,68 @@
+package caddy_docker_upstreams
+
+import (
+	"net/http"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// Reasons for which no upstream is available.
+const (
+	// ReasonNoContainer means no container of the block matches the request.
+	ReasonNoContainer = "no_container"
+
+	// ReasonUnhealthy means containers match the request, but fail their
+	// health checks, Docker's or the module's.
+	ReasonUnhealthy = "unhealthy"
+
+	// ReasonStarting means containers match the request, but Docker has not
+	// found them healthy yet, e.g. while they restart.
+	ReasonStarting = "starting"
+
+	// ReasonDraining means containers match the request, but all of them are
+	// draining.
+	ReasonDraining = "draining"
+)
+
+// UnavailableError is the error GetUpstreams returns, with UnavailableError
+// set, when no upstream can serve the request.
+type UnavailableError struct {
+	// Reason is ReasonNoContainer, ReasonUnhealthy, ReasonStarting or
+	// ReasonDraining.
+	Reason string
+}
+
+func (e *UnavailableError) Error() string {
+	return "no docker upstream available: " + e.Reason
+}
+
+// unavailable explains why the block has no upstream for the request. The
+// containers held back are those its selectors and matchers pick regardless
+// of split groups and routes. It must be called with candidatesMu held.
+func (u *Upstreams) unavailable(r *http.Request) *UnavailableError {
+	var unhealthy, starting, draining bool
+	for _, c := range candidates {
+		if c.source != u.source || c.stopped || !u.selects(c) || !c.matchers.Match(r) {
+			continue
+		}
+		switch {
+		case c.held == container.Starting:
+			starting = true
+		case c.held != "", u.health.failing(c.id):
+			unhealthy = true
+		case u.drains(c):
+			draining = true
+		}
+	}
+
+	switch {
+	case unhealthy:
+		return &UnavailableError{Reason: ReasonUnhealthy}
+	case starting:
+		return &UnavailableError{Reason: ReasonStarting}
+	case draining:
+		return &UnavailableError{Reason: ReasonDraining}
+	default:
+		return &UnavailableError{Reason: ReasonNoContainer}
+	}
+}
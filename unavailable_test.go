@@ -0,0 +1,174 @@
+package caddy_docker_upstreams
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUpstreamsUnavailableError(t *testing.T) {
+	withCandidates(t)
+	withDraining(t)
+
+	host := func(name string) caddyhttp.MatcherSet {
+		m := caddyhttp.MatchHost{name}
+		require.NoError(t, m.Provision(newTestContext(t)))
+		return caddyhttp.MatcherSet{&m}
+	}
+
+	candidatesMu.Lock()
+	candidates = []candidate{
+		{id: "sick", address: "10.0.0.1", port: "8080", matchers: host("sick.example.com")},
+		{id: "stopping", address: "10.0.0.2", port: "8080", matchers: host("stopping.example.com")},
+		{id: "mixed-sick", address: "10.0.0.3", port: "8080", matchers: host("mixed.example.com")},
+		{id: "mixed-stopping", address: "10.0.0.4", port: "8080", matchers: host("mixed.example.com")},
+	}
+	candidatesMu.Unlock()
+
+	drainingMu.Lock()
+	draining["stopping"] = time.Now()
+	draining["mixed-stopping"] = time.Now()
+	drainingMu.Unlock()
+
+	u := Upstreams{UnavailableError: true, health: newHealthChecker()}
+	u.health.states["sick"] = &probeState{failing: true}
+	u.health.states["mixed-sick"] = &probeState{failing: true}
+
+	tests := []struct {
+		host   string
+		reason string
+	}{
+		{host: "nothing.example.com", reason: ReasonNoContainer},
+		{host: "sick.example.com", reason: ReasonUnhealthy},
+		{host: "stopping.example.com", reason: ReasonDraining},
+		{host: "mixed.example.com", reason: ReasonUnhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, "http://"+tt.host+"/")
+			repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+			got, err := u.GetUpstreams(req)
+			assert.Empty(t, got)
+
+			var unavailable *UnavailableError
+			require.True(t, errors.As(err, &unavailable), "expected an *UnavailableError, got %v", err)
+			assert.Equal(t, tt.reason, unavailable.Reason)
+			assert.Equal(t, tt.reason, repl.ReplaceAll("{http.docker.unavailable}", ""))
+		})
+	}
+}
+
+func TestGetUpstreamsUnavailableErrorDisabled(t *testing.T) {
+	withCandidates(t)
+
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var u Upstreams
+	got, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	_, ok := repl.Get("http.docker.unavailable")
+	assert.False(t, ok)
+}
+
+func TestProvisionCandidatesHoldsContainersLeftOutByHealth(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	u := Upstreams{UnavailableError: true}
+	assert.NotContains(t, u.filters(), "health", "the health policy is applied by the module")
+
+	listed := func(id, host, status string) container.Summary {
+		c := summary(id,
+			map[string]string{LabelUpstreamPort: "8080", LabelMatchHost: host},
+			map[string]string{"bridge": "10.0.0.1"},
+		)
+		c.State = container.StateRunning
+		c.Status = status
+		return c
+	}
+
+	cli := &mockDockerClient{}
+	cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+		Return(client.ContainerListResult{Items: []container.Summary{
+			listed("restarting", "restarting.example.com", "Up 2 seconds (health: starting)"),
+			listed("sick", "sick.example.com", "Up 1 hour (unhealthy)"),
+			listed("serving", "serving.example.com", "Up 1 hour (healthy)"),
+		}}, nil)
+	require.NoError(t, u.provisionCandidates(ctx, cli))
+
+	tests := []struct {
+		host   string
+		reason string
+	}{
+		{host: "restarting.example.com", reason: ReasonStarting},
+		{host: "sick.example.com", reason: ReasonUnhealthy},
+		{host: "nothing.example.com", reason: ReasonNoContainer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://"+tt.host+"/"))
+			assert.Empty(t, got)
+
+			var unavailable *UnavailableError
+			require.True(t, errors.As(err, &unavailable), "expected an *UnavailableError, got %v", err)
+			assert.Equal(t, tt.reason, unavailable.Reason)
+		})
+	}
+
+	got, err := u.GetUpstreams(newRequest(t, http.MethodGet, "http://serving.example.com/"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, upstreamDials(got))
+
+	// Without the option, Docker filters the list on health as before.
+	var plain Upstreams
+	assert.Contains(t, plain.filters(), "health")
+}
+
+func TestProvisionCandidatesHoldsPerHealthPolicy(t *testing.T) {
+	withCandidates(t)
+	ctx := newTestContext(t)
+
+	healthyOnly := &Upstreams{UnavailableError: true, HealthPolicy: healthPolicyHealthyOnly}
+	anyHealth := &Upstreams{UnavailableError: true, HealthPolicy: healthPolicyAny}
+	require.NotEqual(t, healthyOnly.discoveryKey(), anyHealth.discoveryKey(),
+		"blocks holding back different containers must not share candidates")
+
+	starting := summary("starting",
+		map[string]string{LabelUpstreamPort: "8080"},
+		map[string]string{"bridge": "10.0.0.1"},
+	)
+	starting.State = container.StateRunning
+	starting.Status = "Up 2 seconds (health: starting)"
+
+	for _, u := range []*Upstreams{healthyOnly, anyHealth} {
+		u.source = u.discoveryKey()
+		cli := &mockDockerClient{}
+		cli.On("ContainerList", mock.Anything, client.ContainerListOptions{Filters: u.filters()}).
+			Return(client.ContainerListResult{Items: []container.Summary{starting}}, nil)
+		require.NoError(t, u.provisionCandidates(ctx, cli))
+	}
+
+	_, err := healthyOnly.GetUpstreams(newRequest(t, http.MethodGet, "http://example.com/"))
+	var unavailable *UnavailableError
+	require.True(t, errors.As(err, &unavailable), "expected an *UnavailableError, got %v", err)
+	assert.Equal(t, ReasonStarting, unavailable.Reason)
+
+	got, err := anyHealth.GetUpstreams(newRequest(t, http.MethodGet, "http://example.com/"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, upstreamDials(got))
+}
@@ -1,11 +1,13 @@
 package caddy_docker_upstreams
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
+	"net/netip"
+	"os"
 	"slices"
 	"sync"
 	"time"
@@ -15,7 +17,6 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/moby/moby/api/types/container"
-	"github.com/moby/moby/api/types/events"
 	"github.com/moby/moby/client"
 	"go.uber.org/zap"
 )
@@ -24,6 +25,11 @@ const (
 	LabelEnable       = "com.caddyserver.http.enable"
 	LabelNetwork      = "com.caddyserver.http.network"
 	LabelUpstreamPort = "com.caddyserver.http.upstream.port"
+	LabelUpstreamUnix = "com.caddyserver.http.upstream.unix"
+	LabelUpstreamID   = "com.caddyserver.http.upstream.id"
+
+	LabelUpstreamScheme        = "com.caddyserver.http.upstream.scheme"
+	LabelUpstreamTLSServerName = "com.caddyserver.http.upstream.tls_server_name"
 )
 
 const (
@@ -39,15 +45,52 @@ func init() {
 // Its purpose is to allow testing this module with mocks.
 type dockerClient interface {
 	ContainerList(ctx context.Context, options client.ContainerListOptions) (client.ContainerListResult, error)
+	ContainerInspect(ctx context.Context, containerID string, options client.ContainerInspectOptions) (client.ContainerInspectResult, error)
 	Events(ctx context.Context, options client.EventsListOptions) client.EventsResult
+	NetworkConnect(ctx context.Context, networkID string, options client.NetworkConnectOptions) (client.NetworkConnectResult, error)
+	NetworkDisconnect(ctx context.Context, networkID string, options client.NetworkDisconnectOptions) (client.NetworkDisconnectResult, error)
+	ContainerStart(ctx context.Context, containerID string, options client.ContainerStartOptions) (client.ContainerStartResult, error)
+	ContainerStop(ctx context.Context, containerID string, options client.ContainerStopOptions) (client.ContainerStopResult, error)
 	Close() error
 }
 
 type candidate struct {
+	source   string // discovery key of the blocks that provisioned it
+	id       string // container ID
 	matchers caddyhttp.MatcherSet
 	labels   map[string]string
+	host     string // from the matchers.host label, with its templates expanded
+	path     string // from the matchers.path label, with its templates expanded
 	address  string // container IP address, without a port
 	port     string // port from the upstream.port label; empty when the label is absent
+	network  string // name of the network the address belongs to
+	unix     string // socket path from the upstream.unix label; dialed instead of address
+
+	upstreamID string // from the upstream.id label; orders the candidates
+
+	names []string // container names, without the leading slash
+	image string   // image reference the container was created from
+
+	scheme        string // from the upstream.scheme label; schemeHTTP when the label is absent
+	tlsServerName string // from the upstream.tls_server_name label
+
+	drain bool // from the drain label
+
+	discovered   time.Time     // first discovery; zero when serving since this block's first listing
+	slowStart    time.Duration // from the slow_start label
+	hasSlowStart bool          // whether the slow_start label is set
+
+	health healthCheck // from the health labels
+
+	rewrite requestRewrite // from the rewrite and headers labels
+
+	hostNetwork bool                      // container shares the host's network stack
+	published   map[string]netip.AddrPort // published TCP ports, keyed by private port
+
+	stopped  bool          // stopped scale-to-zero container; it has no address until started
+	idleStop time.Duration // from the idle_stop label
+
+	held container.HealthStatus // Docker health the health policy leaves out; empty when admitted
 }
 
 var (
@@ -55,11 +98,6 @@ var (
 	candidatesMu sync.RWMutex
 )
 
-var defaultFilters = client.Filters{}.
-	Add("label", fmt.Sprintf("%s=true", LabelEnable)).
-	Add("status", "running"). // container.State.Status
-	Add("health", string(container.Healthy), string(container.NoHealthcheck))
-
 // Upstreams provides upstreams from the docker host.
 type Upstreams struct {
 	// Labels narrows the containers this source considers to those whose
@@ -75,11 +113,180 @@ type Upstreams struct {
 	//	label com.docker.compose.service first
 	Labels map[string][]string `json:"labels,omitempty"`
 
+	// LabelExists narrows the candidates to containers that carry each of
+	// these labels, whatever their value.
+	LabelExists []string `json:"label_exists,omitempty"`
+
+	// LabelNot leaves out the containers whose label equals one of the listed
+	// values, or, with no values, the containers that carry the label at all:
+	//
+	//	label_not com.docker.compose.service canary
+	LabelNot map[string][]string `json:"label_not,omitempty"`
+
+	// LabelMatch narrows the candidates to containers whose label matches one
+	// of the listed regular expressions.
+	LabelMatch map[string][]string `json:"label_match,omitempty"`
+
+	// LabelSelector is a Kubernetes-style label selector, e.g.
+	// "tier in (web,api), track notin (canary), !legacy". All selectors
+	// above and Labels must hold for a container to be selected.
+	LabelSelector string `json:"label_selector,omitempty"`
+
+	// ContainerName narrows the candidates to containers with a name that
+	// matches one of these glob patterns, e.g. web-*.
+	ContainerName []string `json:"container_name,omitempty"`
+
+	// Image narrows the candidates to containers created from an image that
+	// matches one of these glob patterns, e.g. nginx or ghcr.io/example/*.
+	// A pattern without a tag or digest matches any tag of the image.
+	Image []string `json:"image,omitempty"`
+
+	// ComposeProject and ComposeService are shorthands for selecting on the
+	// com.docker.compose.project and com.docker.compose.service labels.
+	ComposeProject string   `json:"compose_project,omitempty"`
+	ComposeService []string `json:"compose_service,omitempty"`
+
+	// Split divides the traffic between groups of the selected containers,
+	// e.g. for canary releases driven by a version label.
+	Split *Split `json:"split,omitempty"`
+
+	// RouteByLabel routes each request to the containers whose label equals
+	// the value of a request header.
+	RouteByLabel *RouteByLabel `json:"route_by_label,omitempty"`
+
 	// Port overrides the upstream port for every container this source
 	// considers. When set, it takes precedence over the per-container
 	// com.caddyserver.http.upstream.port label and makes that label optional.
 	Port string `json:"port,omitempty"`
 
+	// AutoConnect attaches Caddy's own container to the network each
+	// candidate is reached through, so backends on networks Caddy was not
+	// started on become reachable. Caddy is detached again from a network
+	// once no candidate uses it; networks Caddy was already attached to are
+	// never detached.
+	AutoConnect bool `json:"auto_connect,omitempty"`
+
+	// Container names or identifies Caddy's own container for AutoConnect.
+	// Defaults to the hostname, which Docker sets to the short container ID.
+	Container string `json:"container,omitempty"`
+
+	// AddressMode chooses how a container is dialed:
+	//
+	//   - container_ip (default) dials the container's IP on its network.
+	//   - published dials the host port the upstream port is published on,
+	//     for when Caddy runs on the host rather than in a container.
+	//   - host dials Host for containers that use the host network, and the
+	//     container IP for the others.
+	AddressMode string `json:"address_mode,omitempty"`
+
+	// Host is the address dialed in the published and host address modes.
+	// Defaults to the IP a port is published on when that is specific, and
+	// to 127.0.0.1 otherwise.
+	Host string `json:"host,omitempty"`
+
+	// Scheme narrows the containers this source considers to those whose
+	// com.caddyserver.http.upstream.scheme label equals it: http, h2c or
+	// https. Containers without the label are http. This lets a block with a
+	// matching transport serve only the containers it can speak to.
+	Scheme string `json:"scheme,omitempty"`
+
+	// HealthTLSTrustedCACerts are PEM files of the CAs whose certificates
+	// the active health checks of https containers trust, in place of the
+	// system roots, as the transport's tls_trust_pool file does for
+	// proxied requests.
+	HealthTLSTrustedCACerts []string `json:"health_tls_trusted_ca_certs,omitempty"`
+
+	// HealthTLSInsecureSkipVerify turns off certificate verification in
+	// the active health checks of https containers, as the transport's
+	// tls_insecure_skip_verify does for proxied requests.
+	HealthTLSInsecureSkipVerify bool `json:"health_tls_insecure_skip_verify,omitempty"`
+
+	// HealthPolicy chooses the Docker health states a container may be in:
+	// healthy_only, healthy_or_none (default), include_starting or any.
+	HealthPolicy string `json:"health_policy,omitempty"`
+
+	// EnableBy chooses which containers are enabled: label (default) enables
+	// only those labeled com.caddyserver.http.enable=true; default_on
+	// enables every container that matches this block's selectors, except
+	// those labeled com.caddyserver.http.enable=false. The latter suits
+	// Compose stacks whose containers cannot be labeled, narrowed down with
+	// compose_project.
+	EnableBy string `json:"enable_by,omitempty"`
+
+	// Status lists the container states to consider. Defaults to running.
+	Status []string `json:"status,omitempty"`
+
+	// Filters are extra Docker API filters merged into the container list,
+	// e.g. {"network": ["backend"]}. See the docker container ls
+	// documentation for the available filters.
+	Filters map[string][]string `json:"filters,omitempty"`
+
+	// LabelPrefix namespaces the labels this block reads, in place of
+	// com.caddyserver.http, e.g. com.example.internal for
+	// com.example.internal.enable. Instances sharing a Docker daemon can
+	// each discover only their own containers this way.
+	LabelPrefix string `json:"label_prefix,omitempty"`
+
+	// DrainTimeout is how long a container is kept out of new requests once
+	// it is seen stopping (a kill or stop event), ahead of the refresh that
+	// drops it. A container still running after this is considered again.
+	// Defaults to 30s.
+	DrainTimeout caddy.Duration `json:"drain_timeout,omitempty"`
+
+	// SlowStart ramps up the traffic a newly discovered container receives
+	// over this window, so it can warm up before taking its full share. The
+	// com.caddyserver.http.slow_start label overrides it per container.
+	// Containers found by the first listing are already serving and are not
+	// ramped up.
+	SlowStart caddy.Duration `json:"slow_start,omitempty"`
+
+	// UnavailableError makes GetUpstreams return an *UnavailableError when
+	// no upstream can serve the request, telling whether no container
+	// matches it or the matching ones are unhealthy, starting or draining.
+	// The containers the health policy leaves out are listed for this, and
+	// the policy is applied to the list by the module. The reverse
+	// proxy then falls back to its static upstreams, or answers 503, and the
+	// reason is available as {http.docker.unavailable}, e.g. in
+	// handle_errors.
+	UnavailableError bool `json:"unavailable_error,omitempty"`
+
+	// WaitForUpstream holds a request no upstream can serve for up to this
+	// long, retrying as the candidates are updated, e.g. while a deploy
+	// replaces a container. Without it, such requests fail right away.
+	WaitForUpstream caddy.Duration `json:"wait_for_upstream,omitempty"`
+
+	// ScaleToZero keeps the stopped containers labeled with
+	// com.caddyserver.http.idle_stop among the candidates. A request they
+	// match starts them, and waits for up to WaitForUpstream, 30s by
+	// default, for them to be running and healthy. Containers that go
+	// without requests for their idle_stop duration, through any block,
+	// are stopped again.
+	ScaleToZero bool `json:"scale_to_zero,omitempty"`
+
+	// Engine is the container engine serving the API: docker, the default,
+	// or podman. With podman, the API is found at the Podman socket unless
+	// DOCKER_HOST is set, health is read from the container status rather
+	// than filtered on, containers in rootless user mode networks are kept
+	// for the published address mode, and the health check events Podman
+	// repeats are ignored.
+	Engine string `json:"engine,omitempty"`
+
+	// requirements are the compiled label selectors other than Labels.
+	requirements []requirement
+
+	// source is the discovery key of this block; see discoveryKey.
+	source string
+
+	// provisioned is set once this block has listed containers.
+	provisioned bool
+
+	// health tracks the active health checks of this block's candidates.
+	health *healthChecker
+
+	// ctx and client start scale-to-zero containers.
+	ctx    caddy.Context
+	client dockerClient
+
 	debounceInterval time.Duration
 	reconnectDelay   time.Duration
 }
@@ -97,94 +304,246 @@ func (Upstreams) CaddyModule() caddy.ModuleInfo {
 }
 
 func (u *Upstreams) provisionCandidates(ctx caddy.Context, cli dockerClient) error {
-	containers, err := cli.ContainerList(ctx, client.ContainerListOptions{Filters: defaultFilters})
+	containers, err := cli.ContainerList(ctx, client.ContainerListOptions{Filters: u.filters()})
 	if err != nil {
 		return fmt.Errorf("listing docker containers: %w", err)
 	}
 
+	if u.ScaleToZero {
+		stopped, err := cli.ContainerList(ctx, client.ContainerListOptions{All: true, Filters: u.stoppedFilters()})
+		if err != nil {
+			return fmt.Errorf("listing stopped docker containers: %w", err)
+		}
+		for _, c := range stopped.Items {
+			if !slices.ContainsFunc(containers.Items, func(listed container.Summary) bool { return listed.ID == c.ID }) {
+				containers.Items = append(containers.Items, c)
+			}
+		}
+	}
+
+	var attached map[string]bool
+	if u.AutoConnect {
+		attached, err = u.selfNetworks(ctx, cli)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	discovered := discoveryTimes(u.source)
+
 	updated := make([]candidate, 0, len(containers.Items))
 
 	for _, c := range containers.Items {
-		// Build matchers.
-		matchers := buildMatchers(ctx, c.Labels)
-
-		// Candidates are shared by every dynamic docker block, so provisioning
-		// must not fold in per-block configuration such as the port directive.
-		// Record the container IP and its optional port label here; the
-		// effective port is resolved per request in GetUpstreams.
-
-		// Choose network to connect.
-		if len(c.NetworkSettings.Networks) == 0 {
-			ctx.Logger().Error("unable to get ip address from container networks",
-				zap.String("container_id", c.ID),
-			)
+		// Read this block's labels under their default names from here on,
+		// keeping the container's own labels for the label selectors.
+		labels := c.Labels
+		c.Labels = u.moduleLabels(labels)
+
+		// Without the enable filter, containers opt out with the label.
+		if c.Labels[LabelEnable] == "false" {
 			continue
 		}
 
-		var address string
-		network, ok := c.Labels[LabelNetwork]
-		if !ok {
-			// Use the first network settings of container.
-			for _, settings := range c.NetworkSettings.Networks {
-				address = settings.IPAddress.String()
-				break
+		// Containers the health policy leaves out are only kept to explain
+		// why no upstream is available.
+		var held container.HealthStatus
+		if u.healthInCode() && !isStopped(c) && !u.admitsHealth(c) {
+			if !u.UnavailableError {
+				continue
 			}
-		} else {
-			settings, ok := c.NetworkSettings.Networks[network]
-			if !ok {
-				// Add project prefix. See also https://github.com/compose-spec/compose-go/blob/main/loader/normalize.go.
-				const projectLabel = "com.docker.compose.project"
-				project, ok := c.Labels[projectLabel]
-				if !ok {
-					ctx.Logger().Error("unable to get network settings from container",
-						zap.String("container_id", c.ID),
-						zap.String("network", network),
-					)
-					continue
-				}
+			held = listedHealth(c)
+		}
 
-				network = fmt.Sprintf("%s_%s", project, network)
-				settings, ok = c.NetworkSettings.Networks[network]
-				if !ok {
-					ctx.Logger().Error("unable to get network settings from container",
-						zap.String("container_id", c.ID),
-						zap.String("network", network),
-					)
-					continue
-				}
+		// Build matchers.
+		matchers, ok := buildMatchers(ctx, c)
+		if !ok {
+			continue
+		}
+
+		// Candidates are shared by the blocks with the same discovery key,
+		// which may still differ in per-block configuration such as the port
+		// directive, so provisioning must not fold it in. Record the container
+		// IP and its optional port label here; the effective port is resolved
+		// per request in GetUpstreams.
+
+		// A container reached through a Unix socket needs no network, and a
+		// stopped one has no address until it is started.
+		unix := c.Labels[LabelUpstreamUnix]
+		idleStop := parseIdleStop(ctx, c)
+		stopped := u.ScaleToZero && idleStop > 0 && isStopped(c)
+
+		var network, address string
+		userNetwork := u.Engine == enginePodman && podmanUserNetwork(c)
+		if unix == "" && !stopped && !userNetwork {
+			var ok bool
+			network, address, ok = chooseNetwork(ctx, c, attached)
+			if !ok {
+				continue
 			}
-			address = settings.IPAddress.String()
 		}
 
+		// Containers already serving when this block first lists them are
+		// not ramped up.
+		first, ok := discovered[c.ID]
+		if !ok && u.provisioned {
+			first = now
+		}
+
+		slowStart, hasSlowStart := parseSlowStart(ctx, c)
+
 		updated = append(updated, candidate{
-			matchers: matchers,
-			labels:   c.Labels,
-			address:  address,
-			port:     c.Labels[LabelUpstreamPort],
+			source:     u.source,
+			id:         c.ID,
+			matchers:   matchers,
+			labels:     labels,
+			host:       expandLabel(c, LabelMatchHost),
+			path:       expandLabel(c, LabelMatchPath),
+			upstreamID: c.Labels[LabelUpstreamID],
+
+			names:   containerNames(c.Names),
+			image:   c.Image,
+			address: address,
+			port:    c.Labels[LabelUpstreamPort],
+			network: network,
+			unix:    unix,
+
+			scheme:        cmp.Or(c.Labels[LabelUpstreamScheme], schemeHTTP),
+			tlsServerName: c.Labels[LabelUpstreamTLSServerName],
+
+			drain: c.Labels[LabelDrain] == "true",
+
+			discovered:   first,
+			slowStart:    slowStart,
+			hasSlowStart: hasSlowStart,
+
+			health: parseHealthCheck(ctx, c),
+
+			rewrite: parseRequestRewrite(c.Labels),
+
+			hostNetwork: c.HostConfig.NetworkMode == "host",
+			published:   publishedPorts(c.Ports),
+
+			stopped:  stopped,
+			idleStop: idleStop,
+
+			held: held,
 		})
 	}
 
+	// Daemon list order changes from one listing to the next; keep the
+	// upstreams in a stable order so order-based selection policies see
+	// the same upstreams in the same place across refreshes.
+	slices.SortStableFunc(updated, compareCandidates)
+
 	candidatesMu.Lock()
-	candidates = updated
+	candidates = replaceSource(candidates, u.source, updated)
+	all := candidates
+	notifyChanged()
 	candidatesMu.Unlock()
 
+	u.provisioned = true
+
+	pruneDraining(all)
+
+	if u.AutoConnect {
+		u.connectNetworks(ctx, cli, attached, all)
+	}
+
 	return nil
 }
 
+// compareCandidates orders candidates by their upstream.id label, those
+// without one last, then by container name and ID, which survive a refresh
+// unlike the daemon's list order. Only order-based selection policies, such
+// as first and round_robin, depend on it; the hash policies hash the dial
+// address instead.
+func compareCandidates(a, b candidate) int {
+	if (a.upstreamID == "") != (b.upstreamID == "") {
+		if a.upstreamID == "" {
+			return 1
+		}
+		return -1
+	}
+	return cmp.Or(
+		cmp.Compare(a.upstreamID, b.upstreamID),
+		slices.Compare(a.names, b.names),
+		cmp.Compare(a.id, b.id),
+	)
+}
+
+// chooseNetwork picks the network the container is dialed through: the one
+// named by the network label, or else the first one, preferring a network in
+// attached. It reports false when no usable network is found.
+func chooseNetwork(ctx caddy.Context, c container.Summary, attached map[string]bool) (string, string, bool) {
+	if len(c.NetworkSettings.Networks) == 0 {
+		ctx.Logger().Error("unable to get ip address from container networks",
+			zap.String("container_id", c.ID),
+		)
+		return "", "", false
+	}
+
+	var address string
+	network, ok := c.Labels[LabelNetwork]
+	if !ok {
+		// Use the first network settings of container, preferring a
+		// network Caddy is already attached to.
+		for name, settings := range c.NetworkSettings.Networks {
+			network, address = name, settings.IPAddress.String()
+			if attached[name] {
+				break
+			}
+		}
+	} else {
+		settings, ok := c.NetworkSettings.Networks[network]
+		if !ok {
+			// Add project prefix. See also https://github.com/compose-spec/compose-go/blob/main/loader/normalize.go.
+			project, ok := c.Labels[composeProjectLabel]
+			if !ok {
+				ctx.Logger().Error("unable to get network settings from container",
+					zap.String("container_id", c.ID),
+					zap.String("network", network),
+				)
+				return "", "", false
+			}
+
+			network = fmt.Sprintf("%s_%s", project, network)
+			settings, ok = c.NetworkSettings.Networks[network]
+			if !ok {
+				ctx.Logger().Error("unable to get network settings from container",
+					zap.String("container_id", c.ID),
+					zap.String("network", network),
+				)
+				return "", "", false
+			}
+		}
+		address = settings.IPAddress.String()
+	}
+
+	return network, address, true
+}
+
 func (u *Upstreams) keepUpdated(ctx caddy.Context, cli dockerClient) {
 	defer cli.Close()
 
 	debounced := debounce.New(u.debounceInterval)
 
+	var podman *podmanEvents
+	if u.Engine == enginePodman {
+		podman = newPodmanEvents()
+	}
+
 	for {
-		messages := cli.Events(ctx, client.EventsListOptions{
-			Filters: client.Filters{}.Add("type", string(events.ContainerEventType)),
-		})
+		messages := cli.Events(ctx, client.EventsListOptions{Filters: u.eventFilters()})
 
 	selectLoop:
 		for {
 			select {
-			case <-messages.Messages:
+			case msg := <-messages.Messages:
+				if podman != nil && !podman.relevant(msg) {
+					continue
+				}
+				observeDrain(msg)
 				debounced(func() {
 					err := u.provisionCandidates(ctx, cli)
 					if err != nil {
@@ -215,13 +574,44 @@ func (u *Upstreams) provision(ctx caddy.Context, cli *client.Client) error {
 		return err
 	}
 
+	u.ctx = ctx
+	u.client = cli
 	go u.keepUpdated(ctx, cli)
 
+	if u.ScaleToZero {
+		go u.stopIdle(ctx, cli, idleCheckInterval)
+	}
+
+	u.health = newHealthChecker()
+	u.health.tls, err = u.healthTLSConfig()
+	if err != nil {
+		return err
+	}
+	go u.checkHealth(ctx)
+
 	return nil
 }
 
 func (u *Upstreams) Provision(ctx caddy.Context) error {
-	cli, err := client.New(client.FromEnv)
+	// The selectors are compiled before the discovery key is taken, as
+	// some are pushed down to the container list. The key is retained even
+	// when that fails, as Cleanup also runs when provisioning fails.
+	err := u.compileSelectors()
+	u.source = u.discoveryKey()
+	retainSource(u.source)
+	if err != nil {
+		return err
+	}
+
+	if u.AutoConnect && u.Container == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("resolving caddy container: %w", err)
+		}
+		u.Container = hostname
+	}
+
+	cli, err := client.New(u.clientOptions()...)
 	if err != nil {
 		return fmt.Errorf("provisioning docker client: %w", err)
 	}
@@ -235,51 +625,238 @@ func (u *Upstreams) Provision(ctx caddy.Context) error {
 	return u.provision(ctx, cli)
 }
 
+// Cleanup drops the candidates discovered for this block, unless another
+// block still discovers them the same way.
+func (u *Upstreams) Cleanup() error {
+	releaseSource(u.source)
+	return nil
+}
+
 func (u *Upstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
-	upstreams := make([]*reverseproxy.Upstream, 0, 1)
+	upstreams, selected, unavailable, next := u.lookup(r)
+
+	wait := time.Duration(u.WaitForUpstream)
+	if len(upstreams) == 0 && u.ScaleToZero && u.startStopped(r) {
+		wait = cmp.Or(wait, defaultStartTimeout)
+	}
+
+	if len(upstreams) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+	wait:
+		for len(upstreams) == 0 {
+			select {
+			case <-next:
+				upstreams, selected, unavailable, next = u.lookup(r)
+			case <-timer.C:
+				break wait
+			case <-r.Context().Done():
+				break wait
+			}
+		}
+	}
 
+	markUsed(r.Context(), selected, time.Now())
+
+	publishPlaceholders(r, upstreams, selected, unavailable)
+
+	if unavailable != nil {
+		return nil, unavailable
+	}
+	return upstreams, nil
+}
+
+// lookup returns the upstreams that may serve the request with their
+// candidates, or why there are none when UnavailableError is set, and a
+// channel closed on the next update of the candidates.
+func (u *Upstreams) lookup(r *http.Request) ([]*reverseproxy.Upstream, []candidate, *UnavailableError, <-chan struct{}) {
 	candidatesMu.RLock()
 	defer candidatesMu.RUnlock()
 
+	now := time.Now()
+
+	var upstreams []*reverseproxy.Upstream
+	var selected []candidate
+
+	group := u.Split.choose(r)
+	for _, route := range u.RouteByLabel.values(r) {
+		upstreams, selected = u.collect(r, now, group, route)
+		if len(upstreams) == 0 && group >= 0 {
+			// The chosen group has nothing to serve, e.g. before a canary
+			// is deployed; serve the request from the other groups instead.
+			upstreams, selected = u.collect(r, now, -1, route)
+		}
+		if len(upstreams) > 0 {
+			break
+		}
+	}
+
+	var unavailable *UnavailableError
+	if len(upstreams) == 0 && u.UnavailableError {
+		unavailable = u.unavailable(r)
+	}
+
+	return upstreams, selected, unavailable, changed
+}
+
+// collect returns the upstreams of this block that may serve the request
+// from the given split group and route, with the candidates they were built
+// from. It must be called with candidatesMu held.
+func (u *Upstreams) collect(r *http.Request, now time.Time, group int, route string) ([]*reverseproxy.Upstream, []candidate) {
+	upstreams := make([]*reverseproxy.Upstream, 0, 1)
+	selected := make([]candidate, 0, 1)
+
+	// Warming candidates that sit out this request, kept in case no other
+	// candidate remains.
+	var benched []*reverseproxy.Upstream
+	var benchedCandidates []candidate
+
 	for _, c := range candidates {
+		if c.source != u.source || c.stopped || c.held != "" {
+			continue
+		}
 		if !u.selects(c) {
 			continue
 		}
+		if !u.Split.serves(c, group) {
+			continue
+		}
+		if !u.RouteByLabel.serves(c, route) {
+			continue
+		}
+		if u.drains(c) {
+			continue
+		}
+		if u.health.failing(c.id) {
+			continue
+		}
 		if !c.matchers.Match(r) {
 			continue
 		}
 
-		// Resolve the port for this block: the port directive takes precedence
-		// over the per-container label. This is done here rather than at
-		// provision time because candidates are shared across all blocks.
-		port := u.Port
-		if port == "" {
-			port = c.port
+		address, ok := u.dial(c)
+		if !ok {
+			continue
 		}
-		if port == "" {
+
+		if share, ok := u.warming(c, now); ok && !admits(share) {
+			benched = append(benched, &reverseproxy.Upstream{Dial: address})
+			benchedCandidates = append(benchedCandidates, c)
 			continue
 		}
 
-		upstreams = append(upstreams, &reverseproxy.Upstream{Dial: net.JoinHostPort(c.address, port)})
+		upstreams = append(upstreams, &reverseproxy.Upstream{Dial: address})
+		selected = append(selected, c)
 	}
 
-	return upstreams, nil
+	if len(upstreams) == 0 && len(benched) > 0 {
+		return benched, benchedCandidates
+	}
+	return upstreams, selected
 }
 
-// selects reports whether the candidate's container satisfies u.Labels. Every
-// configured key must be present with a value among those listed for it.
+// selects reports whether the candidate's container satisfies u.Labels, the
+// compiled label selectors, the name and image selectors and the scheme
+// selector. Every key in u.Labels must be present with a value among those
+// listed for it.
 func (u *Upstreams) selects(c candidate) bool {
+	if u.Scheme != "" && u.Scheme != c.scheme {
+		return false
+	}
 	for key, values := range u.Labels {
 		got, ok := c.labels[key]
 		if !ok || !slices.Contains(values, got) {
 			return false
 		}
 	}
+	if !matchesAll(u.requirements, c.labels) {
+		return false
+	}
+	if len(u.ContainerName) > 0 && !slices.ContainsFunc(c.names, func(name string) bool {
+		return matchGlobs(u.ContainerName, name)
+	}) {
+		return false
+	}
+	if len(u.Image) > 0 && !matchImage(u.Image, c.image) {
+		return false
+	}
 	return true
 }
 
+func (u *Upstreams) Validate() error {
+	switch u.AddressMode {
+	case "", addressModeContainerIP:
+		if u.Host != "" {
+			return fmt.Errorf("host requires the %s or %s address mode", addressModePublished, addressModeHost)
+		}
+	case addressModePublished, addressModeHost:
+	default:
+		return fmt.Errorf("unrecognized address mode '%s'", u.AddressMode)
+	}
+
+	switch u.Scheme {
+	case "", schemeHTTP, schemeH2C, schemeHTTPS:
+	default:
+		return fmt.Errorf("unrecognized scheme '%s'", u.Scheme)
+	}
+
+	switch u.EnableBy {
+	case "", enableByLabel, enableByDefaultOn:
+	default:
+		return fmt.Errorf("unrecognized enable_by '%s'", u.EnableBy)
+	}
+
+	switch u.HealthPolicy {
+	case "", healthPolicyHealthyOnly, healthPolicyHealthyOrNone, healthPolicyIncludeStarting, healthPolicyAny:
+	default:
+		return fmt.Errorf("unrecognized health policy '%s'", u.HealthPolicy)
+	}
+
+	switch u.Engine {
+	case "", engineDocker, enginePodman:
+	default:
+		return fmt.Errorf("unrecognized engine '%s'", u.Engine)
+	}
+
+	err := u.Split.validate()
+	if err != nil {
+		return err
+	}
+
+	err = u.RouteByLabel.validate()
+	if err != nil {
+		return err
+	}
+
+	for _, pattern := range slices.Concat(u.ContainerName, u.Image) {
+		err := validGlob(pattern)
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.validateStatus()
+}
+
+// validateStatus checks the status filters against the states of the engine.
+func (u *Upstreams) validateStatus() error {
+	for _, status := range u.Status {
+		if u.Engine == enginePodman && status == string(podmanStateStopped) {
+			continue
+		}
+		err := container.ValidateContainerState(container.ContainerState(status))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Upstreams)(nil)
+	_ caddy.CleanerUpper          = (*Upstreams)(nil)
+	_ caddy.Validator             = (*Upstreams)(nil)
 	_ reverseproxy.UpstreamSource = (*Upstreams)(nil)
 )
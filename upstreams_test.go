@@ -277,6 +277,31 @@ func (m *mockDockerClient) ContainerList(ctx context.Context, options client.Con
 	return args.Get(0).(client.ContainerListResult), args.Error(1)
 }
 
+func (m *mockDockerClient) ContainerInspect(ctx context.Context, containerID string, options client.ContainerInspectOptions) (client.ContainerInspectResult, error) {
+	args := m.Called(ctx, containerID, options)
+	return args.Get(0).(client.ContainerInspectResult), args.Error(1)
+}
+
+func (m *mockDockerClient) NetworkConnect(ctx context.Context, networkID string, options client.NetworkConnectOptions) (client.NetworkConnectResult, error) {
+	args := m.Called(ctx, networkID, options)
+	return args.Get(0).(client.NetworkConnectResult), args.Error(1)
+}
+
+func (m *mockDockerClient) NetworkDisconnect(ctx context.Context, networkID string, options client.NetworkDisconnectOptions) (client.NetworkDisconnectResult, error) {
+	args := m.Called(ctx, networkID, options)
+	return args.Get(0).(client.NetworkDisconnectResult), args.Error(1)
+}
+
+func (m *mockDockerClient) ContainerStart(ctx context.Context, containerID string, options client.ContainerStartOptions) (client.ContainerStartResult, error) {
+	args := m.Called(ctx, containerID, options)
+	return args.Get(0).(client.ContainerStartResult), args.Error(1)
+}
+
+func (m *mockDockerClient) ContainerStop(ctx context.Context, containerID string, options client.ContainerStopOptions) (client.ContainerStopResult, error) {
+	args := m.Called(ctx, containerID, options)
+	return args.Get(0).(client.ContainerStopResult), args.Error(1)
+}
+
 func (m *mockDockerClient) Events(ctx context.Context, options client.EventsListOptions) client.EventsResult {
 	m.eventsCalls.Add(1)
 	return m.Called(ctx, options).Get(0).(client.EventsResult)
@@ -350,11 +375,11 @@ func TestKeepUpdatedReprovisionsOnEvent(t *testing.T) {
 
 	stream := newEventStream()
 	cli := &mockDockerClient{}
-	cli.On("Events", mock.Anything, mock.Anything).Return(stream.result())
 	cli.On("ContainerList", mock.Anything, mock.Anything).Return(oneContainerResult(), nil)
 	cli.On("Close").Return(nil)
 
 	u := &Upstreams{debounceInterval: time.Millisecond, reconnectDelay: time.Millisecond}
+	cli.On("Events", mock.Anything, client.EventsListOptions{Filters: u.eventFilters()}).Return(stream.result())
 	done := make(chan struct{})
 	go func() {
 		u.keepUpdated(ctx, cli)
@@ -472,3 +497,71 @@ func TestCaddyModuleDefaults(t *testing.T) {
 	assert.Equal(t, defaultDebounceInterval, u.debounceInterval)
 	assert.Equal(t, defaultReconnectDelay, u.reconnectDelay)
 }
+
+func TestGetUpstreamsWaitsForUpstream(t *testing.T) {
+	withCandidates(t)
+
+	u := Upstreams{WaitForUpstream: caddy.Duration(time.Minute)}
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+
+	type result struct {
+		upstreams []*reverseproxy.Upstream
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		upstreams, err := u.GetUpstreams(req)
+		done <- result{upstreams, err}
+	}()
+
+	// An unrelated update wakes the request, which keeps waiting.
+	candidatesMu.Lock()
+	notifyChanged()
+	candidatesMu.Unlock()
+
+	select {
+	case <-done:
+		t.Fatal("GetUpstreams returned before a candidate was added")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	candidatesMu.Lock()
+	candidates = []candidate{{id: "new", address: "10.0.0.1", port: "8080"}}
+	notifyChanged()
+	candidatesMu.Unlock()
+
+	select {
+	case got := <-done:
+		require.NoError(t, got.err)
+		assert.Equal(t, []string{"10.0.0.1:8080"}, upstreamDials(got.upstreams))
+	case <-time.After(2 * time.Second):
+		t.Fatal("GetUpstreams did not return after a candidate was added")
+	}
+}
+
+func TestGetUpstreamsWaitForUpstreamTimesOut(t *testing.T) {
+	withCandidates(t)
+
+	u := Upstreams{WaitForUpstream: caddy.Duration(10 * time.Millisecond), UnavailableError: true}
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+
+	start := time.Now()
+	got, err := u.GetUpstreams(req)
+	assert.Empty(t, got)
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+}
+
+func TestGetUpstreamsWaitForUpstreamStopsOnCanceledRequest(t *testing.T) {
+	withCandidates(t)
+
+	u := Upstreams{WaitForUpstream: caddy.Duration(time.Minute)}
+	req := newRequest(t, http.MethodGet, "http://example.com/")
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	req = req.WithContext(ctx)
+
+	got, err := u.GetUpstreams(req)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}